@@ -0,0 +1,241 @@
+// Package admin serves the downloader's admin API, which reports the status
+// of every source, and lets operators run a source on demand instead of
+// waiting for its schedule, follow the run, and cancel it. Every request to
+// /runs has to carry the admin token as a bearer token.
+//
+// The endpoints are:
+//
+//	GET    /status            the status of every source, as JSON
+//	GET    /status.html       the same, as a web page
+//	GET    /healthz           whether no run is stuck, for liveness probes
+//	GET    /readyz            whether the store can be used, for readiness probes
+//	POST   /runs              run every source, or only those given by source=
+//	GET    /runs              list the runs in flight and the recent ones
+//	GET    /runs/<id>         get a run
+//	DELETE /runs/<id>         cancel a run, pending or in flight
+//
+// POST /runs and GET /runs/<id> take wait=true to answer only once the runs
+// are over.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/downloader/download"
+	"github.com/m-lab/downloader/metrics"
+	"github.com/m-lab/downloader/scheduler"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// handler serves the admin API of a Scheduler.
+type handler struct {
+	sched         *scheduler.Scheduler
+	token         string
+	livenessBound time.Duration
+	ready         func() error
+}
+
+// NewHandler returns the admin API of sched, with /runs guarded by token.
+// If token is empty, /runs is refused. /healthz fails while a run has made
+// no progress for livenessBound, and /readyz while ready returns an error.
+func NewHandler(sched *scheduler.Scheduler, token string, livenessBound time.Duration, ready func() error) http.Handler {
+	h := &handler{sched: sched, token: token, livenessBound: livenessBound, ready: ready}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/status", h.status)
+	mux.HandleFunc("/status.html", h.statusPage)
+	mux.Handle("/runs", h.authenticate(http.HandlerFunc(h.runs)))
+	mux.Handle("/runs/", h.authenticate(http.HandlerFunc(h.run)))
+	return mux
+}
+
+// healthz fails if a run is stuck, so that the downloader is restarted.
+func (h *handler) healthz(w http.ResponseWriter, r *http.Request) {
+	if stalled := h.sched.Stalled(h.livenessBound); len(stalled) > 0 {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Stalled Run"}).Inc()
+		run := stalled[0]
+		since := run.Start
+		if run.Progress.After(since) {
+			since = run.Progress
+		}
+		msg := fmt.Sprintf("run %s of %s has made no progress since %s", run.ID, run.Job, since.Format(time.RFC3339))
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz fails while the store can't be used.
+func (h *handler) readyz(w http.ResponseWriter, r *http.Request) {
+	if err := h.ready(); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// statuses returns the status of every source, with its next run.
+func (h *handler) statuses() []download.Status {
+	statuses := download.Statuses()
+	for i := range statuses {
+		statuses[i].NextRun = h.sched.NextRun(statuses[i].Source)
+	}
+	return statuses
+}
+
+// status serves the status of every source as JSON.
+func (h *handler) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.statuses())
+}
+
+// statusPage serves the status of every source as a web page.
+func (h *handler) statusPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, h.statuses()); err != nil {
+		log.Println(err)
+	}
+}
+
+// authenticate rejects the requests that don't carry h.token.
+func (h *handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Admin Unauthorized"}).Inc()
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runs lists the runs, or triggers new ones.
+func (h *handler) runs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.sched.Runs())
+	case http.MethodPost:
+		wait, ok := waitParam(w, r)
+		if !ok {
+			return
+		}
+		sources := r.URL.Query()["source"]
+		if len(sources) == 0 {
+			sources = h.sched.Jobs()
+		}
+		var runs []scheduler.Run
+		for _, src := range sources {
+			run, err := h.sched.Trigger(src)
+			if err != nil {
+				// The runs already triggered go on, and are listed by GET.
+				writeError(w, err)
+				return
+			}
+			log.Println("Triggered run", run.ID, "of", src)
+			runs = append(runs, run)
+		}
+		if !wait {
+			writeJSON(w, http.StatusAccepted, runs)
+			return
+		}
+		for i := range runs {
+			var err error
+			if runs[i], err = h.sched.Wait(r.Context(), runs[i].ID); err != nil {
+				// The client has gone away.
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, runs)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// run gets or cancels the run whose ID ends the path.
+func (h *handler) run(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/runs/")
+	switch r.Method {
+	case http.MethodGet:
+		wait, ok := waitParam(w, r)
+		if !ok {
+			return
+		}
+		var run scheduler.Run
+		var err error
+		if wait {
+			run, err = h.sched.Wait(r.Context(), id)
+			if err != nil && err != scheduler.ErrUnknownRun {
+				// The client has gone away.
+				return
+			}
+		} else {
+			run, err = h.sched.Lookup(id)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+	case http.MethodDelete:
+		run, err := h.sched.Cancel(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Println("Canceled run", run.ID, "of", run.Job)
+		writeJSON(w, http.StatusOK, run)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// waitParam returns the wait parameter of r. If it is malformed, the
+// error is written to w, and false is returned.
+func waitParam(w http.ResponseWriter, r *http.Request) (wait bool, ok bool) {
+	s := r.URL.Query().Get("wait")
+	if s == "" {
+		return false, true
+	}
+	wait, err := strconv.ParseBool(s)
+	if err != nil {
+		http.Error(w, "bad wait parameter: "+s, http.StatusBadRequest)
+		return false, false
+	}
+	return wait, true
+}
+
+// writeError writes the HTTP status that fits err, a scheduler error.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case scheduler.ErrUnknownJob, scheduler.ErrUnknownRun:
+		status = http.StatusNotFound
+	case scheduler.ErrFinished:
+		status = http.StatusConflict
+	case scheduler.ErrNotRunning:
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// writeJSON writes v to w as JSON, with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,261 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/downloader/download"
+	"github.com/m-lab/downloader/file"
+	"github.com/m-lab/downloader/scheduler"
+)
+
+// never is a Timing that only lets jobs run when they are triggered.
+type never struct{}
+
+func (never) Timer(now time.Time) (*time.Timer, time.Time) {
+	return time.NewTimer(24 * time.Hour), now.Add(24 * time.Hour)
+}
+
+// okSource is a download.Source that has nothing to fetch.
+type okSource struct{}
+
+func (okSource) Name() string        { return "ok" }
+func (okSource) MetricLabel() string { return "ok" }
+func (okSource) Discover(ctx context.Context, store file.Store) ([]download.Candidate, error) {
+	return nil, nil
+}
+func (okSource) Fetch(ctx context.Context, store file.Store, c download.Candidate) error { return nil }
+
+func init() {
+	download.Register(okSource{})
+}
+
+// newServer returns a test server for the admin API of a running
+// Scheduler with the jobs "ok", which succeeds, and "stuck", which runs
+// until it is canceled. The scheduled runs are over, or in flight, by then.
+func newServer(t *testing.T) *httptest.Server {
+	s := &scheduler.Scheduler{Grace: time.Millisecond}
+	store := file.NewLocalStore(t.TempDir())
+	s.Add("ok", never{}, func(ctx context.Context) error { return download.Run(ctx, okSource{}, store) })
+	s.Add("stuck", never{}, func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.New("stopped")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(stopped)
+	}()
+	for len(s.Runs()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	srv := httptest.NewServer(NewHandler(s, "secret", time.Hour, func() error { return nil }))
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+		<-stopped
+	})
+	return srv
+}
+
+// do sends an authenticated request, and decodes the JSON answer into v,
+// unless v is nil.
+func do(t *testing.T, method string, url string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAuthentication(t *testing.T) {
+	srv := newServer(t)
+	for _, auth := range []string{"", "secret", "Bearer wrong", "Basic c2VjcmV0"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/runs", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q got status %d, expected %d", auth, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+	if status := do(t, http.MethodGet, srv.URL+"/runs", nil); status != http.StatusOK {
+		t.Errorf("GET /runs got status %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestTriggerAndWait(t *testing.T) {
+	srv := newServer(t)
+	var runs []scheduler.Run
+	if status := do(t, http.MethodPost, srv.URL+"/runs?source=ok&wait=true", &runs); status != http.StatusOK {
+		t.Fatalf("POST /runs got status %d, expected %d", status, http.StatusOK)
+	}
+	if len(runs) != 1 || runs[0].Job != "ok" || runs[0].State != scheduler.Succeeded || !runs[0].Manual {
+		t.Errorf("POST /runs returned %+v, expected a successful manual run of ok", runs)
+	}
+	var run scheduler.Run
+	if status := do(t, http.MethodGet, srv.URL+"/runs/"+runs[0].ID, &run); status != http.StatusOK || run.ID != runs[0].ID {
+		t.Errorf("GET /runs/%s got status %d and %+v", runs[0].ID, status, run)
+	}
+	if status := do(t, http.MethodPost, srv.URL+"/runs?source=nope", nil); status != http.StatusNotFound {
+		t.Errorf("POST /runs of an unknown source got status %d, expected %d", status, http.StatusNotFound)
+	}
+	if status := do(t, http.MethodPost, srv.URL+"/runs?wait=maybe", nil); status != http.StatusBadRequest {
+		t.Errorf("POST /runs with a bad wait got status %d, expected %d", status, http.StatusBadRequest)
+	}
+	if status := do(t, http.MethodGet, srv.URL+"/runs/nope", nil); status != http.StatusNotFound {
+		t.Errorf("GET of an unknown run got status %d, expected %d", status, http.StatusNotFound)
+	}
+}
+
+func TestTriggerAllAndCancel(t *testing.T) {
+	srv := newServer(t)
+	var runs []scheduler.Run
+	if status := do(t, http.MethodPost, srv.URL+"/runs", &runs); status != http.StatusAccepted {
+		t.Fatalf("POST /runs got status %d, expected %d", status, http.StatusAccepted)
+	}
+	if len(runs) != 2 || runs[0].Job != "ok" || runs[1].Job != "stuck" {
+		t.Fatalf("POST /runs returned %+v, expected a run of every source", runs)
+	}
+	// The scheduled run of stuck is still in flight.
+	if runs[1].State != scheduler.Pending {
+		t.Errorf("The triggered run of stuck is %s, expected %s", runs[1].State, scheduler.Pending)
+	}
+	var all []scheduler.Run
+	do(t, http.MethodGet, srv.URL+"/runs", &all)
+	for _, r := range all {
+		if r.Job == "stuck" && !r.Finished() {
+			if status := do(t, http.MethodDelete, srv.URL+"/runs/"+r.ID, nil); status != http.StatusOK {
+				t.Errorf("DELETE /runs/%s got status %d, expected %d", r.ID, status, http.StatusOK)
+			}
+		}
+	}
+	var run scheduler.Run
+	do(t, http.MethodGet, srv.URL+"/runs/"+runs[1].ID+"?wait=true", &run)
+	if run.State != scheduler.Canceled {
+		t.Errorf("The canceled run is %s, expected %s", run.State, scheduler.Canceled)
+	}
+	if status := do(t, http.MethodDelete, srv.URL+"/runs/"+runs[1].ID, nil); status != http.StatusConflict {
+		t.Errorf("DELETE of a finished run got status %d, expected %d", status, http.StatusConflict)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	srv := newServer(t)
+	// Make sure the scheduled run of ok is over.
+	do(t, http.MethodPost, srv.URL+"/runs?source=ok&wait=true", nil)
+
+	// No token is needed.
+	var statuses []download.Status
+	for start := time.Now(); time.Since(start) < time.Minute; time.Sleep(time.Millisecond) {
+		resp, err := http.Get(srv.URL + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&statuses)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The next run is known once the scheduler is done with the first.
+		if len(statuses) != 1 || !statuses[0].NextRun.IsZero() {
+			break
+		}
+	}
+	if len(statuses) != 1 || statuses[0].Source != "ok" || statuses[0].LastSuccess.IsZero() {
+		t.Fatalf("/status returned %+v, expected a success of ok", statuses)
+	}
+	if next := statuses[0].NextRun; time.Until(next) < 23*time.Hour {
+		t.Errorf("/status gave the next run as %v, expected it a day from now", next)
+	}
+
+	resp, err := http.Get(srv.URL + "/status.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := new(strings.Builder)
+	_, err = io.Copy(body, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body.String(), "<td>ok</td>") || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("/status.html returned %s, expected a row for ok", body)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s := &scheduler.Scheduler{Grace: time.Millisecond}
+	s.Add("stuck", never{}, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	for len(s.Runs()) == 0 || s.Runs()[0].State != scheduler.Running {
+		time.Sleep(time.Millisecond)
+	}
+	var storeErr error
+	srv := httptest.NewServer(NewHandler(s, "", time.Millisecond, func() error { return storeErr }))
+	defer srv.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get("/readyz"); status != http.StatusOK {
+		t.Errorf("/readyz got status %d, expected %d", status, http.StatusOK)
+	}
+	storeErr = errors.New("no credentials")
+	if status := get("/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz got status %d without a store, expected %d", status, http.StatusServiceUnavailable)
+	}
+	// The run has been stuck for longer than the bound.
+	time.Sleep(5 * time.Millisecond)
+	if status := get("/healthz"); status != http.StatusServiceUnavailable {
+		t.Errorf("/healthz got status %d with a stuck run, expected %d", status, http.StatusServiceUnavailable)
+	}
+	for _, r := range s.Runs() {
+		s.Cancel(r.ID)
+		s.Wait(context.Background(), r.ID)
+	}
+	if status := get("/healthz"); status != http.StatusOK {
+		t.Errorf("/healthz got status %d without runs, expected %d", status, http.StatusOK)
+	}
+}
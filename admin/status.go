@@ -0,0 +1,52 @@
+package admin
+
+import (
+	"html/template"
+	"time"
+)
+
+// statusTemplate renders a list of download.Status as a web page.
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"when": when,
+	"now":  time.Now,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>downloader status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>downloader status</h1>
+<table>
+<tr>
+<th>Source</th><th>Last attempt</th><th>Last success</th><th>Last error</th>
+<th>Last object</th><th>Current</th><th>Seqnum</th><th>Next run</th>
+</tr>
+{{range .}}<tr>
+<td>{{.Source}}</td>
+<td>{{when .LastAttempt}}</td>
+<td>{{when .LastSuccess}}</td>
+<td class="error">{{if .LastError}}{{when .LastErrorTime}}: {{.LastError}}{{end}}</td>
+<td>{{.LastObject}}</td>
+<td>{{if .CurrentName}}{{.CurrentName}} &rarr; {{.CurrentTarget}}{{end}}</td>
+<td>{{if .Seqnum}}{{.Seqnum}}{{end}}</td>
+<td>{{when .NextRun}}</td>
+</tr>
+{{end}}</table>
+<p>As of {{when now}}. Also available as <a href="status">JSON</a>.</p>
+</body>
+</html>
+`))
+
+// when formats t for the status page, leaving it blank if it is unknown.
+func when(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	conf "github.com/m-lab/downloader/config"
+	"github.com/m-lab/downloader/download"
+	"github.com/m-lab/downloader/file"
+)
+
+// usage describes the subcommands that can be given after the flags.
+const usage = `usage: downloader [flags] [command]
+
+Without a command, the downloader keeps every dataset up to date until it is
+killed. The commands are:
+
+  quarantine list [dataset]  list the files that were rejected, oldest first
+  quarantine release <name>  put the quarantined file <name> where it would
+                             have been kept had it not been rejected
+  backfill -from <date> [-to <date>] [-datasets <names>] [-interval <duration>]
+                             fetch the files published from -from to -to, both
+                             inclusive, of the comma separated datasets, or of
+                             every dataset, without touching current. Dates are
+                             given as 2006-01-02. Run it again to resume`
+
+// runCommand runs the subcommand args against store and the datasets of
+// cfg, writing its output to w.
+func runCommand(ctx context.Context, store file.Store, cfg *conf.Config, args []string, w io.Writer) error {
+	switch args[0] {
+	case "quarantine":
+		return quarantineCommand(ctx, store, args[1:], w)
+	case "backfill":
+		return backfillCommand(ctx, store, cfg, args[1:], w)
+	default:
+		return errors.New("unknown command " + args[0] + "\n" + usage)
+	}
+}
+
+// quarantineCommand lists or releases quarantined files.
+func quarantineCommand(ctx context.Context, store file.Store, args []string, w io.Writer) error {
+	switch {
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "list":
+		dataset := ""
+		if len(args) == 2 {
+			dataset = args[1]
+		}
+		items, err := download.ListQuarantined(ctx, store, dataset)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tDATASET\tTIME\tREASON")
+		for _, q := range items {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", q.Name, q.Dataset, q.Time.Format("2006-01-02T15:04:05Z"), q.Reason)
+		}
+		return tw.Flush()
+	case len(args) == 2 && args[0] == "release":
+		q, promoted, err := download.ReleaseQuarantined(ctx, store, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "Released", q.Name, "to", q.ArchiveName)
+		if !promoted && q.CurrentName != "" {
+			fmt.Fprintln(w, "Left", q.CurrentName, "alone, a newer version was kept since")
+		}
+		return nil
+	default:
+		return errors.New("bad quarantine command\n" + usage)
+	}
+}
+
+// backfillCommand fetches the past files of some or all of the datasets
+// of cfg, one dataset after the other, and writes what happened to each.
+func backfillCommand(ctx context.Context, store file.Store, cfg *conf.Config, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	flags.SetOutput(w)
+	fromDate := flags.String("from", "", "The first day to fetch the files of, as 2006-01-02.")
+	toDate := flags.String("to", time.Now().UTC().Format("2006-01-02"), "The last day to fetch the files of, as 2006-01-02.")
+	names := flags.String("datasets", "", "The comma separated datasets to backfill. Defaults to all of them.")
+	interval := flags.Duration("interval", time.Minute, "How long to wait between files, to stay within the rate limits of the servers, such as MaxMind's daily download limit.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *fromDate == "" || flags.NArg() > 0 {
+		return errors.New("bad backfill command\n" + usage)
+	}
+	from, err := time.Parse("2006-01-02", *fromDate)
+	if err != nil {
+		return err
+	}
+	to, err := time.Parse("2006-01-02", *toDate)
+	if err != nil {
+		return err
+	}
+	to = to.AddDate(0, 0, 1)
+
+	var sources []download.Backfiller
+	wanted := map[string]bool{}
+	for _, name := range strings.Split(*names, ",") {
+		if name != "" {
+			wanted[name] = true
+		}
+	}
+	for _, ds := range cfg.Datasets {
+		if len(wanted) > 0 && !wanted[ds.Name] {
+			continue
+		}
+		delete(wanted, ds.Name)
+		src, err := download.NewSource(ds, nil)
+		if err != nil {
+			return err
+		}
+		b, ok := src.(download.Backfiller)
+		if !ok {
+			return errors.New("dataset " + ds.Name + " can't be backfilled")
+		}
+		sources = append(sources, b)
+	}
+	for name := range wanted {
+		return errors.New("unknown dataset " + name)
+	}
+
+	var lastErr error
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATASET\tCANDIDATES\tSKIPPED\tFETCHED\tFAILED")
+	for _, src := range sources {
+		r, err := download.Backfill(ctx, src, store, from, to, *interval)
+		if err != nil {
+			log.Println(src.Name()+":", err)
+			lastErr = err
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", src.Name(), r.Candidates, r.Skipped, r.Fetched, r.Failed)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return lastErr
+}
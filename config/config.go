@@ -0,0 +1,413 @@
+// Package config loads the declarative description of the datasets that the
+// downloader keeps up to date. Configs are YAML files, and because YAML is a
+// superset of JSON, JSON files work too.
+package config
+
+import (
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+	"gopkg.in/yaml.v2"
+)
+
+// maxmindEditionURL is the permalink of a MaxMind edition, given the
+// edition and the suffix of its archive.
+const maxmindEditionURL = "https://download.maxmind.com/geoip/databases/%s/download?suffix=%s"
+
+var maxmindEditionRegexp = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// The kinds of dataset the downloader knows how to fetch.
+const (
+	KindMaxmind    = "maxmind"
+	KindRouteviews = "routeviews"
+)
+
+//go:embed default.yaml
+var defaultYAML []byte
+
+// Config lists the datasets the downloader keeps up to date, and who to
+// tell about their new files.
+type Config struct {
+	Datasets []Dataset `yaml:"datasets"`
+	Webhooks []Webhook `yaml:"webhooks"`
+}
+
+// Webhook is an HTTP endpoint that is sent every new file of every
+// dataset. Requests are signed with Secret, a secret reference in the
+// format of ResolveSecret.
+type Webhook struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+}
+
+// Dataset describes a single dataset. Which fields are required depends on
+// its Kind.
+type Dataset struct {
+	Name        string `yaml:"name"`         // Unique name, used in logs.
+	Kind        string `yaml:"kind"`         // KindMaxmind or KindRouteviews.
+	Edition     string `yaml:"edition"`      // The MaxMind edition, for maxmind datasets.
+	MetricLabel string `yaml:"metric_label"` // Label for metrics. Defaults to Name.
+	URL         string `yaml:"url"`          // The file to download, for maxmind datasets.
+	// The SHA-256 companion of URL, for maxmind datasets. Files that don't
+	// match it are refused.
+	ChecksumURL string `yaml:"checksum_url"`
+	Log         string `yaml:"log"`          // The discovery log, for routeviews datasets.
+	PathPrefix  string `yaml:"path_prefix"`  // The prefix to put all archived files under.
+	Filename    string `yaml:"filename"`     // The name to save the file as, for maxmind datasets.
+	CurrentName string `yaml:"current_name"` // Where to copy the newest file, if anywhere.
+	// The regexp applied to the URL to create the filename. The first
+	// matching group goes before the timestamp, the second after.
+	URLRegexp *Regexp `yaml:"url_regexp"`
+	// The regexp applied to the filename to determine the directory to
+	// dedupe in. Its first matching group is the directory.
+	DedupRegexp *Regexp `yaml:"dedup_regexp"`
+	// The names of the checks every new file has to pass before it is
+	// copied to current. Files that fail are quarantined. If not set, each
+	// kind has its own defaults, and an empty list disables them.
+	Validators []string `yaml:"validators"`
+	// The most the size, record count or prefix count of a new file may
+	// differ from the last version, as a percentage, before it is
+	// quarantined instead of copied to current. 0 allows any change.
+	MaxDeltaPercent float64 `yaml:"max_delta_percent"`
+	// Whether to keep new files whatever their change from the last
+	// version, e.g. to accept a known big change without raising
+	// MaxDeltaPercent. The change is still logged and exported.
+	Force    bool     `yaml:"force"`
+	Auth     Auth     `yaml:"auth"`
+	Schedule Schedule `yaml:"schedule"`
+}
+
+// Auth holds references to the HTTP Basic Auth credentials of a dataset.
+// See ResolveSecret for the format of the references.
+type Auth struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// The kinds of Schedule.
+const (
+	ScheduleMemoryless = "memoryless"
+	ScheduleFixed      = "fixed"
+	ScheduleCron       = "cron"
+)
+
+// Schedule says when to check a dataset for new files. With Kind
+// ScheduleMemoryless, the default, the time between checks is
+// exponentially distributed, with an average of Interval, but never less
+// than Min or, if it is set, more than Max. With ScheduleFixed, checks are
+// Interval apart. With ScheduleCron, checks are at the times given by
+// Cron, a standard five field cron expression, in UTC. Whatever the kind,
+// each check is further delayed by a uniformly random amount of up to
+// Jitter.
+type Schedule struct {
+	Kind     string        `yaml:"kind"`
+	Interval time.Duration `yaml:"interval"`
+	Min      time.Duration `yaml:"min"`
+	Max      time.Duration `yaml:"max"`
+	Cron     string        `yaml:"cron"`
+	Jitter   time.Duration `yaml:"jitter"`
+}
+
+// Regexp is a regular expression that is compiled when the config is loaded.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// UnmarshalYAML compiles the regexp, so that typos are reported along with
+// the rest of the config errors.
+func (r *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return fmt.Errorf("invalid regexp %q: %v", s, err)
+	}
+	r.Regexp = re
+	return nil
+}
+
+// Load reads and validates the config in the named file.
+func Load(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return c, nil
+}
+
+// Default returns the config of the datasets that the downloader collects
+// when it is not given a config file.
+func Default() *Config {
+	c, err := Parse(defaultYAML)
+	if err != nil {
+		panic("config: invalid default.yaml: " + err.Error())
+	}
+	return c
+}
+
+// Parse decodes and validates a YAML or JSON config. Fields that are not
+// part of the config are errors, so that typos do not go unnoticed.
+func Parse(b []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, err
+	}
+	for i := range c.Datasets {
+		c.Datasets[i].setDefaults()
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (d *Dataset) setDefaults() {
+	if d.Kind == KindMaxmind && maxmindEditionRegexp.MatchString(d.Edition) {
+		d.setEditionDefaults()
+	}
+	if d.MetricLabel == "" {
+		d.MetricLabel = d.Name
+	}
+	if d.Schedule.Kind == "" {
+		d.Schedule.Kind = ScheduleMemoryless
+	}
+	if d.Schedule.Interval == 0 && d.Schedule.Kind != ScheduleCron {
+		d.Schedule.Interval = 24 * time.Hour
+	}
+}
+
+// setEditionDefaults fills in the fields of a maxmind dataset that were
+// left empty from its edition. Every edition gets its own directory,
+// Maxmind/<edition>/, with its own current copy and metric label, and is
+// checked against the SHA-256 that MaxMind publishes next to it. CSV
+// editions are zip files, the others are tarballs.
+func (d *Dataset) setEditionDefaults() {
+	suffix := "tar.gz"
+	if strings.HasSuffix(d.Edition, "-CSV") {
+		suffix = "zip"
+	}
+	if d.URL == "" {
+		d.URL = fmt.Sprintf(maxmindEditionURL, d.Edition, suffix)
+	}
+	if d.ChecksumURL == "" {
+		d.ChecksumURL = fmt.Sprintf(maxmindEditionURL, d.Edition, suffix+".sha256")
+	}
+	if d.Filename == "" {
+		d.Filename = d.Edition + "." + suffix
+	}
+	if d.PathPrefix == "" {
+		d.PathPrefix = "Maxmind/" + d.Edition + "/"
+	}
+	if d.CurrentName == "" {
+		d.CurrentName = "Maxmind/" + d.Edition + "/current/" + d.Filename
+	}
+	if d.MetricLabel == "" {
+		d.MetricLabel = "Maxmind/" + d.Edition
+	}
+}
+
+// Validate checks that every dataset is complete and consistent. The error
+// lists every problem found, each prefixed with the dataset it is in.
+func (c *Config) Validate() error {
+	var problems []string
+	if len(c.Datasets) == 0 {
+		problems = append(problems, "no datasets are configured")
+	}
+	names := map[string]bool{}
+	for i, d := range c.Datasets {
+		where := fmt.Sprintf("datasets[%d]", i)
+		if d.Name != "" {
+			where += " (" + d.Name + ")"
+		}
+		for _, p := range d.problems() {
+			problems = append(problems, where+": "+p)
+		}
+		if names[d.Name] {
+			problems = append(problems, where+": name is used by more than one dataset")
+		}
+		names[d.Name] = true
+	}
+	for i, w := range c.Webhooks {
+		where := fmt.Sprintf("webhooks[%d]", i)
+		for _, p := range w.problems() {
+			problems = append(problems, where+": "+p)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// problems returns everything that is wrong with a single dataset.
+func (d *Dataset) problems() []string {
+	var p []string
+	require := func(field, value string) {
+		if value == "" {
+			p = append(p, field+" is required for kind "+d.Kind)
+		}
+	}
+	forbid := func(field, value string) {
+		if value != "" {
+			p = append(p, field+" is not used by kind "+d.Kind)
+		}
+	}
+	if d.Name == "" {
+		p = append(p, "name is required")
+	}
+	if d.PathPrefix == "" {
+		p = append(p, "path_prefix is required")
+	}
+	switch d.Kind {
+	case KindMaxmind:
+		if d.Edition != "" && !maxmindEditionRegexp.MatchString(d.Edition) {
+			p = append(p, "edition "+d.Edition+" is not a MaxMind edition name, like GeoLite2-ASN")
+		}
+		require("url", d.URL)
+		require("filename", d.Filename)
+		forbid("log", d.Log)
+		if d.URLRegexp != nil {
+			p = append(p, "url_regexp is not used by kind "+d.Kind+", use filename")
+		}
+	case KindRouteviews:
+		require("log", d.Log)
+		forbid("edition", d.Edition)
+		forbid("url", d.URL)
+		forbid("checksum_url", d.ChecksumURL)
+		forbid("filename", d.Filename)
+	case "":
+		p = append(p, "kind is required, and must be "+KindMaxmind+" or "+KindRouteviews)
+	default:
+		p = append(p, "unknown kind "+d.Kind+", must be "+KindMaxmind+" or "+KindRouteviews)
+	}
+	if d.URLRegexp != nil && d.URLRegexp.NumSubexp() < 2 {
+		p = append(p, "url_regexp must have two matching groups")
+	}
+	if d.DedupRegexp != nil && d.DedupRegexp.NumSubexp() < 1 {
+		p = append(p, "dedup_regexp must have a matching group")
+	}
+	for field, ref := range map[string]string{"auth.user": d.Auth.User, "auth.password": d.Auth.Password} {
+		if err := checkSecretRef(ref); err != nil {
+			p = append(p, field+": "+err.Error())
+		}
+	}
+	if d.MaxDeltaPercent < 0 {
+		p = append(p, "max_delta_percent must not be negative")
+	}
+	for _, problem := range d.Schedule.problems() {
+		p = append(p, "schedule: "+problem)
+	}
+	return p
+}
+
+// problems returns everything that is wrong with a schedule.
+func (s *Schedule) problems() []string {
+	var p []string
+	if s.Interval < 0 || s.Min < 0 || s.Max < 0 || s.Jitter < 0 {
+		p = append(p, "durations must not be negative")
+	}
+	switch s.Kind {
+	case ScheduleMemoryless:
+		if s.Min > s.Interval || (s.Max != 0 && s.Max < s.Interval) {
+			p = append(p, "interval must be between min and max")
+		}
+	case ScheduleFixed:
+		if s.Min != 0 || s.Max != 0 {
+			p = append(p, "min and max are only used by kind "+ScheduleMemoryless)
+		}
+	case ScheduleCron:
+		if s.Interval != 0 || s.Min != 0 || s.Max != 0 {
+			p = append(p, "interval, min and max are not used by kind "+ScheduleCron)
+		}
+		if _, err := cron.ParseStandard(s.Cron); err != nil {
+			p = append(p, "invalid cron expression "+strconv.Quote(s.Cron)+": "+err.Error())
+		}
+	default:
+		p = append(p, "unknown kind "+s.Kind+", must be "+ScheduleMemoryless+", "+ScheduleFixed+" or "+ScheduleCron)
+	}
+	if s.Kind != ScheduleCron && s.Cron != "" {
+		p = append(p, "cron is only used by kind "+ScheduleCron)
+	}
+	return p
+}
+
+// problems returns everything that is wrong with a single webhook.
+func (w *Webhook) problems() []string {
+	var p []string
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p = append(p, "url must be an http or https URL")
+	}
+	if w.Secret == "" {
+		p = append(p, "secret is required, so that receivers can verify requests")
+	} else if err := checkSecretRef(w.Secret); err != nil {
+		p = append(p, "secret: "+err.Error())
+	}
+	return p
+}
+
+// checkSecretRef returns an error if ref is not a valid secret reference.
+func checkSecretRef(ref string) error {
+	if ref == "" {
+		return nil
+	}
+	scheme, name, _ := strings.Cut(ref, ":")
+	switch scheme {
+	case "env", "file", "flag":
+		if name == "" {
+			return fmt.Errorf("secret reference %q has no name", ref)
+		}
+		return nil
+	}
+	return fmt.Errorf("secret reference %q must start with env:, file: or flag:", ref)
+}
+
+// ResolveSecret returns the secret that ref refers to. An empty ref is an
+// empty secret. Otherwise ref is one of:
+//
+//	env:NAME        the environment variable NAME
+//	file:/a/path    the contents of the file, without trailing whitespace
+//	flag:flag_name  the value of the command line flag flag_name
+//
+// Secrets are resolved every time they are used, so rotated secrets are
+// picked up without a restart.
+func ResolveSecret(ref string) (string, error) {
+	if err := checkSecretRef(ref); err != nil || ref == "" {
+		return "", err
+	}
+	scheme, name, _ := strings.Cut(ref, ":")
+	switch scheme {
+	case "env":
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case "file":
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n\t "), nil
+	default: // "flag"
+		f := flag.Lookup(name)
+		if f == nil {
+			return "", fmt.Errorf("there is no flag named %s", name)
+		}
+		return f.Value.String(), nil
+	}
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefault(t *testing.T) {
+	c := Default()
+	if len(c.Datasets) != 7 {
+		t.Fatalf("Default() has %d datasets, expected 7", len(c.Datasets))
+	}
+	city := c.Datasets[0]
+	if city.Name != "maxmind" || city.Auth.Password != "flag:maxmind_license_key" ||
+		city.URL != "https://download.maxmind.com/geoip/databases/GeoLite2-City/download?suffix=tar.gz" ||
+		city.PathPrefix != "Maxmind/" || city.Filename != "GeoLite2-City.tar.gz" || city.MetricLabel != "Maxmind" {
+		t.Errorf("Default() maxmind dataset is %+v", city)
+	}
+	asnCSV := c.Datasets[4]
+	if asnCSV.URL != "https://download.maxmind.com/geoip/databases/GeoLite2-ASN-CSV/download?suffix=zip" ||
+		asnCSV.ChecksumURL != "https://download.maxmind.com/geoip/databases/GeoLite2-ASN-CSV/download?suffix=zip.sha256" ||
+		asnCSV.PathPrefix != "Maxmind/GeoLite2-ASN-CSV/" ||
+		asnCSV.CurrentName != "Maxmind/GeoLite2-ASN-CSV/current/GeoLite2-ASN-CSV.zip" ||
+		asnCSV.MetricLabel != "Maxmind/GeoLite2-ASN-CSV" || asnCSV.Auth != city.Auth {
+		t.Errorf("Default() ASN CSV dataset is %+v", asnCSV)
+	}
+	if city.Schedule != asnCSV.Schedule || city.Schedule.Kind != ScheduleCron || city.Schedule.Interval != 0 {
+		t.Errorf("Default() maxmind schedule is %+v", city.Schedule)
+	}
+	if rv := c.Datasets[5]; rv.Schedule.Kind != ScheduleMemoryless || rv.Schedule.Interval != 24*time.Hour ||
+		rv.Schedule.Min != 4*time.Hour || rv.Schedule.Max != 48*time.Hour {
+		t.Errorf("Default() routeviews schedule is %+v", rv.Schedule)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		errText string
+	}{
+		{
+			name: "defaults",
+			config: `
+datasets:
+- name: rv
+  kind: routeviews
+  log: http://example.com/pfx2as-creation.log
+  path_prefix: RV/
+  dedup_regexp: (.*)
+`,
+		},
+		{
+			name:   "json",
+			config: `{"datasets": [{"name": "mm", "kind": "maxmind", "url": "http://example.com/x", "path_prefix": "MM/", "filename": "x.tar.gz"}]}`,
+		},
+		{
+			name:    "bad edition",
+			config:  "datasets:\n- {name: mm, kind: maxmind, edition: ../etc}\n",
+			errText: "edition ../etc is not a MaxMind edition name",
+		},
+		{
+			name:    "edition of routeviews",
+			config:  "datasets:\n- {name: rv, kind: routeviews, edition: GeoLite2-ASN, log: http://example.com/log, path_prefix: A/}\n",
+			errText: "edition is not used by kind routeviews",
+		},
+		{
+			name:    "no datasets",
+			config:  `datasets: []`,
+			errText: "no datasets are configured",
+		},
+		{
+			name:    "unknown field",
+			config:  "datasets:\n- name: rv\n  kidn: routeviews\n",
+			errText: "kidn",
+		},
+		{
+			name:    "bad regexp",
+			config:  "datasets:\n- name: rv\n  dedup_regexp: (\n",
+			errText: "invalid regexp",
+		},
+		{
+			name: "missing fields",
+			config: `
+datasets:
+- name: mm
+  kind: maxmind
+  path_prefix: MM/
+`,
+			errText: "datasets[0] (mm): url is required for kind maxmind",
+		},
+		{
+			name: "duplicate names",
+			config: `
+datasets:
+- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/}
+- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: B/}
+`,
+			errText: "datasets[1] (rv): name is used by more than one dataset",
+		},
+		{
+			name:    "unknown kind",
+			config:  "datasets:\n- {name: x, kind: ftp, path_prefix: X/}\n",
+			errText: "unknown kind ftp",
+		},
+		{
+			name:    "too few groups",
+			config:  "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/, url_regexp: (.*)}\n",
+			errText: "url_regexp must have two matching groups",
+		},
+		{
+			name:    "bad secret",
+			config:  "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/, auth: {user: hunter2}}\n",
+			errText: "auth.user: secret reference",
+		},
+		{
+			name: "webhooks",
+			config: `
+datasets:
+- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/}
+webhooks:
+- {url: "https://example.com/hook", secret: "env:HOOK_SECRET"}
+`,
+		},
+		{
+			name:    "bad webhook",
+			config:  "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/}\nwebhooks:\n- {url: example.com}\n",
+			errText: "webhooks[0]: url must be an http or https URL\nwebhooks[0]: secret is required",
+		},
+		{
+			name:    "bad schedule",
+			config:  "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/, schedule: {interval: 1h, min: 3h}}\n",
+			errText: "schedule: interval must be between min and max",
+		},
+		{
+			name:    "unknown schedule",
+			config:  "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/, schedule: {kind: hourly}}\n",
+			errText: "unknown kind hourly",
+		},
+		{
+			name:    "bad cron",
+			config:  "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/, schedule: {kind: cron, cron: \"0 6 * *\"}}\n",
+			errText: "invalid cron expression",
+		},
+		{
+			name:    "cron with interval",
+			config:  "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/, schedule: {kind: cron, cron: \"@daily\", interval: 1h}}\n",
+			errText: "interval, min and max are not used by kind cron",
+		},
+		{
+			name:    "fixed with cron",
+			config:  "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/, schedule: {kind: fixed, cron: \"@daily\"}}\n",
+			errText: "cron is only used by kind cron",
+		},
+		{
+			name:   "memoryless with jitter",
+			config: "datasets:\n- {name: rv, kind: routeviews, log: http://example.com/log, path_prefix: A/, schedule: {interval: 24h, jitter: 1h}}\n",
+		},
+	}
+	for _, test := range tests {
+		c, err := Parse([]byte(test.config))
+		if test.errText == "" {
+			if err != nil {
+				t.Errorf("%s: Parse() returned %v", test.name, err)
+				continue
+			}
+			d := c.Datasets[0]
+			if d.MetricLabel != d.Name || d.Schedule.Interval != 24*time.Hour {
+				t.Errorf("%s: Parse() did not set defaults: %+v", test.name, d)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.errText) {
+			t.Errorf("%s: Parse() returned %v, expected an error containing %q", test.name, err, test.errText)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if _, err := Load(name); err == nil {
+		t.Error("Load() of a missing file should fail")
+	}
+	os.WriteFile(name, []byte("datasets: []"), 0644)
+	if _, err := Load(name); err == nil || !strings.HasPrefix(err.Error(), name) {
+		t.Errorf("Load() returned %v, expected an error naming the file", err)
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	os.Setenv("CONFIG_TEST_SECRET", "from-env")
+	defer os.Unsetenv("CONFIG_TEST_SECRET")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("from-file\n"), 0600)
+	flag.String("config_test_secret", "from-flag", "")
+
+	tests := []struct {
+		ref     string
+		want    string
+		willErr bool
+	}{
+		{ref: "", want: ""},
+		{ref: "env:CONFIG_TEST_SECRET", want: "from-env"},
+		{ref: "env:CONFIG_TEST_UNSET", willErr: true},
+		{ref: "file:" + secretFile, want: "from-file"},
+		{ref: "file:/does/not/exist", willErr: true},
+		{ref: "flag:config_test_secret", want: "from-flag"},
+		{ref: "flag:no_such_flag", willErr: true},
+		{ref: "literal", willErr: true},
+	}
+	for _, test := range tests {
+		got, err := ResolveSecret(test.ref)
+		if (err != nil) != test.willErr || got != test.want {
+			t.Errorf("ResolveSecret(%q) = %q, %v", test.ref, got, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package download
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/m-lab/downloader/file"
+	"github.com/m-lab/downloader/metrics"
+	"github.com/m-lab/downloader/scheduler"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Backfiller is a Source that can also find the files it published in the
+// past, to fill in the gaps of its archive.
+type Backfiller interface {
+	Source
+	// DiscoverRange returns the files published from from up to, but not
+	// including, to, oldest first, with Backfill set.
+	DiscoverRange(ctx context.Context, store file.Store, from time.Time, to time.Time) ([]Candidate, error)
+}
+
+// backfillProgress records the URLs a backfill of a source has already
+// handled, so that an interrupted backfill can be run again without
+// fetching them twice.
+type backfillProgress struct {
+	Source string          `json:"source"`
+	Done   map[string]bool `json:"done"`
+}
+
+// backfillProgressName returns the name of the state object holding the
+// backfill progress of the source named name.
+func backfillProgressName(name string) string {
+	return statePrefix + "backfill/" + strings.Trim(name, "/") + ".json"
+}
+
+// BackfillResult counts what happened to the files of a backfill.
+type BackfillResult struct {
+	Candidates int `json:"candidates"` // The files published in the range.
+	Skipped    int `json:"skipped"`    // Handled by an earlier backfill.
+	Fetched    int `json:"fetched"`    // Handled now.
+	Failed     int `json:"failed"`
+}
+
+// Backfill fetches the files src published from from up to, but not
+// including, to. They go through the same naming, dedup and validation as
+// the files of a regular run, but never replace current. Files handled
+// by an earlier backfill are skipped, so a backfill that was interrupted
+// or failed can simply be run again. interval is waited between files,
+// to go easy on the servers. A file that fails does not stop the others
+// from being fetched, and the last error encountered is returned.
+func Backfill(ctx context.Context, src Backfiller, store file.Store, from time.Time, to time.Time, interval time.Duration) (BackfillResult, error) {
+	var result BackfillResult
+	candidates, err := src.DiscoverRange(ctx, store, from, to)
+	if err != nil {
+		return result, err
+	}
+	result.Candidates = len(candidates)
+	progress := &backfillProgress{}
+	if err := file.ReadJSON(ctx, store, backfillProgressName(src.Name()), progress); err != nil && err != file.ErrNotExist {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Backfill Progress Error"}).Inc()
+		return result, err
+	}
+	progress.Source = src.Name()
+	if progress.Done == nil {
+		progress.Done = map[string]bool{}
+	}
+
+	var lastErr error
+	first := true
+	for _, c := range candidates {
+		if progress.Done[c.URL] {
+			result.Skipped++
+			continue
+		}
+		if !first {
+			if err := scheduler.Sleep(ctx, interval); err != nil {
+				return result, err
+			}
+		}
+		first = false
+		if err := src.Fetch(ctx, store, c); err != nil {
+			log.Println("Backfill of", c.URL, "failed:", err)
+			result.Failed++
+			lastErr = err
+			metrics.FailedDownloadCount.With(prometheus.Labels{"download_type": src.MetricLabel()}).Inc()
+			continue
+		}
+		result.Fetched++
+		progress.Done[c.URL] = true
+		if err := file.WriteJSON(ctx, store, backfillProgressName(src.Name()), progress); err != nil {
+			// The file would only be fetched again, and deduplicated.
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Backfill Progress Error"}).Inc()
+			lastErr = err
+		}
+	}
+	return result, lastErr
+}
@@ -0,0 +1,122 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/m-lab/downloader/config"
+)
+
+// storedNames returns the names of the files in fs that are not state.
+func storedNames(fs *testStore) []string {
+	var names []string
+	for name := range fs.files {
+		if !strings.HasPrefix(name, statePrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBackfillRouteviews(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pfx2as-creation.log" {
+			fmt.Fprint(w, `# seqnum timestamp path
+3363	1497717708	2017/06/routeviews-rv2-20170616-1200.pfx2as.gz
+3364	1497803191	2017/06/routeviews-rv2-20170617-1200.pfx2as.gz
+3365	1497889838	2017/06/routeviews-rv2-20170618-1000.pfx2as.gz
+3366	1497976220	2017/06/routeviews-rv2-20170619-1200.pfx2as.gz`)
+			return
+		}
+		w.Write(gzipped("1.0.0.0\t24\t13335\n" + r.URL.Path + "\n"))
+	}))
+	defer ts.Close()
+	src, err := newRouteviewsSource(conf.Dataset{
+		Name:        "routeviews-v4",
+		Log:         ts.URL + "/pfx2as-creation.log",
+		PathPrefix:  "RouteViewIPv4/",
+		CurrentName: "RouteViewIPv4/current/routeview.pfx2as.gz",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The path in every file makes it unique, but isn't a valid line.
+	src.validators = []Validator{validateGzip}
+	fs := &testStore{map[string]*testFileObject{}}
+
+	// Files are generated the day after the data they hold.
+	from := time.Date(2017, 6, 17, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2017, 6, 19, 0, 0, 0, 0, time.UTC)
+	result, err := Backfill(ctx, src, fs, from, to, time.Millisecond)
+	if err != nil || result != (BackfillResult{Candidates: 2, Fetched: 2}) {
+		t.Errorf("Backfill() = %+v, %v", result, err)
+	}
+	want := []string{
+		"RouteViewIPv4/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz",
+		"RouteViewIPv4/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz",
+	}
+	if got := storedNames(fs); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Backfill() stored %v, expected %v", got, want)
+	}
+	if seqnum, _ := loadCheckpoint(ctx, fs, src.ds.Log); seqnum != 0 {
+		t.Errorf("Backfill() moved the checkpoint to %d", seqnum)
+	}
+
+	// Running it again over a wider range only fetches what's missing.
+	result, err = Backfill(ctx, src, fs, from, to.AddDate(0, 0, 1), 0)
+	if err != nil || result != (BackfillResult{Candidates: 3, Skipped: 2, Fetched: 1}) {
+		t.Errorf("Backfill() again = %+v, %v", result, err)
+	}
+}
+
+func TestBackfillMaxmind(t *testing.T) {
+	ctx := context.Background()
+	release := tarball(map[string][]byte{"GeoLite2-City.mmdb": testMMDB("GeoLite2-City", 6, time.Now())})
+	var dates []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date := r.URL.Query().Get("date")
+		dates = append(dates, date)
+		switch date {
+		case "20240102", "20240105":
+			// The same release is published twice, so it is deduplicated.
+			w.Write(release)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	src, err := newMaxmindSource(conf.Dataset{
+		Name:        "maxmind",
+		URL:         ts.URL + "/geoip/databases/GeoLite2-City/download?suffix=tar.gz",
+		PathPrefix:  "Maxmind/",
+		Filename:    "GeoLite2-City.tar.gz",
+		CurrentName: "Maxmind/current/GeoLite2-City.tar.gz",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &testStore{map[string]*testFileObject{}}
+
+	from := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)
+	result, err := Backfill(ctx, src, fs, from, to, 0)
+	if err != nil || result != (BackfillResult{Candidates: 4, Fetched: 4}) {
+		t.Errorf("Backfill() = %+v, %v", result, err)
+	}
+	// The first day starts after midnight, so it is left out.
+	if got := strings.Join(dates, " "); got != "20240102 20240103 20240104 20240105" {
+		t.Errorf("Backfill() asked for dates %s", got)
+	}
+	want := []string{"Maxmind/2024/01/02/20240102T000000Z-GeoLite2-City.tar.gz"}
+	if got := storedNames(fs); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Backfill() stored %v, expected %v", got, want)
+	}
+}
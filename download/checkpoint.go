@@ -0,0 +1,57 @@
+package download
+
+import (
+	"context"
+
+	"github.com/m-lab/downloader/file"
+)
+
+// checkpoint records the seqnum of the last file listed in a Routeviews
+// generation log that was handled successfully, so that a restarted
+// downloader can resume where it left off.
+type checkpoint struct {
+	LogURL string `json:"log_url"`
+	Seqnum int    `json:"seqnum"`
+}
+
+// checkpointName returns the name of the state object holding the
+// checkpoint for logFileURL.
+func checkpointName(logFileURL string) string {
+	return urlStateName("checkpoints", logFileURL)
+}
+
+// loadCheckpoint returns the last seqnum handled for logFileURL, or 0
+// if nothing has been handled yet.
+func loadCheckpoint(ctx context.Context, store file.Store, logFileURL string) (int, error) {
+	cp := &checkpoint{}
+	err := file.ReadJSON(ctx, store, checkpointName(logFileURL), cp)
+	if err == file.ErrNotExist {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cp.Seqnum, nil
+}
+
+// saveCheckpoint records that every file up to and including seqnum has
+// been handled for logFileURL. The object is replaced in a single step,
+// so a crash leaves either the old checkpoint or the new one.
+func saveCheckpoint(ctx context.Context, store file.Store, logFileURL string, seqnum int) error {
+	return file.WriteJSON(ctx, store, checkpointName(logFileURL), &checkpoint{LogURL: logFileURL, Seqnum: seqnum})
+}
+
+// advanceCheckpoint moves the checkpoint for logFileURL from prev to
+// seqnum. If the checkpoint is no longer at prev, because an earlier
+// file failed or another run got there first, it is left alone. It
+// returns the checkpoint it leaves.
+func advanceCheckpoint(ctx context.Context, store file.Store, logFileURL string, prev int, seqnum int) (int, error) {
+	current, err := loadCheckpoint(ctx, store, logFileURL)
+	if err != nil {
+		return 0, err
+	}
+	if current != prev {
+		return current, nil
+	}
+	return seqnum, saveCheckpoint(ctx, store, logFileURL, seqnum)
+}
@@ -0,0 +1,43 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// fetchChecksum downloads the checksum companion of dc.URL, a file like
+// the output of sha256sum, and returns the SHA-256 in it.
+func fetchChecksum(ctx context.Context, dc config) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dc.ChecksumURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if dc.BasicAuthUser != "" {
+		req.SetBasicAuth(dc.BasicAuthUser, dc.BasicAuthPass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("URL:" + dc.ChecksumURL + " gave response code " + resp.Status)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, errors.New("URL:" + dc.ChecksumURL + " has no checksum")
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, errors.New("URL:" + dc.ChecksumURL + " has no checksum")
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != 32 {
+		return nil, errors.New("URL:" + dc.ChecksumURL + " has a malformed SHA-256 " + fields[0])
+	}
+	return sum, nil
+}
@@ -3,6 +3,9 @@ package download
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"io"
@@ -14,6 +17,8 @@ import (
 
 	"github.com/m-lab/downloader/file"
 	"github.com/m-lab/downloader/metrics"
+	"github.com/m-lab/downloader/notify"
+	"github.com/m-lab/downloader/scheduler"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -35,9 +40,46 @@ type config struct {
 	// The first matching group will go before the timestamp, the second after.
 	DedupRegexp   *regexp.Regexp // The regexp to apply to the filename to determine the directory to dedupe in.
 	FixedFilename string         // The saved file could have fixed filename.
-	MaxDuration   time.Duration  // The longest we allow the download process to go on before we consider it failed.
+	MaxDuration   time.Duration  // The longest we allow the download process to go on before we consider it failed. 0 means no limit.
 	BasicAuthUser string         // The HTTP Basic Auth user string
 	BasicAuthPass string         // The HTTP Basic Auth password string
+	// Whether to remember the ETag and Last-Modified headers of the URL
+	// and only fetch it again if it has changed since.
+	Conditional bool
+	// The URL of a checksum companion of the file, holding its SHA-256 as
+	// written by sha256sum. If set, a file that does not match is refused.
+	ChecksumURL string
+	// Run on every new file before it is copied to current. A file that
+	// fails any of them is quarantined instead.
+	Validators []Validator
+	// Counts the records and prefixes of every new file, if not nil.
+	Counter Counter
+	// Whether the Last-Modified header of the URL is when its data was
+	// published upstream, which the data age of the dataset is measured
+	// from.
+	LastModifiedIsPublished bool
+	// The most any stat of a new file may differ from the last version of
+	// the dataset, as a percentage, before it is quarantined instead of
+	// promoted. 0 allows any change.
+	MaxDeltaPercent float64
+	Dataset         string          // The name of the dataset the file belongs to.
+	Notifier        notify.Notifier // Told about every new file kept, if not nil.
+	// The file is an old version of the dataset, so it is archived without
+	// being compared with, or becoming, the latest version.
+	Backfill bool
+	// Keep the file even if it changed by more than MaxDeltaPercent.
+	Force bool
+	// A 404 means there is nothing to download, rather than an error.
+	MissingOK bool
+	// For a file listed in a generation log, the log and the seqnums of
+	// the file and of the one before it, so that releasing the file from
+	// quarantine can move the checkpoint past it.
+	LogURL     string
+	Seqnum     int
+	PrevSeqnum int
+	// If not nil, nothing is written to the store. What would have
+	// happened to the file is filled in instead.
+	DryRun *PlannedFile
 }
 
 // GenUniformSleepTime generates a random time to sleep (in hours)
@@ -52,18 +94,47 @@ func GenUniformSleepTime(sleepInterval time.Duration, sleepDeviation time.Durati
 // file specified by the URL, storing it in the store implementation
 // that is passed in, in the directory specefied by the prefix, given
 // the number of extra characters from the URL specified by
-// backChars. The error value indicates the error, if any occurred. If
+// backChars. The file is hashed as it streams in, and if it duplicates
+// a file already in the dedup directory it is never committed to the
+// store. The error value indicates the error, if any occurred. If
 // the error value is not nil, then the boolean will also be set. If
 // the boolean is true, that means that the error cannot be fixed by
 // retrying the download. If the boolean is false, that means that the
 // download might work if you attempt it again. If the error value is
 // nil, then the value of the boolean is meaningless.
-func download(ctx context.Context, dc config) errWithPermanence {
-	ctx, cancel := context.WithTimeout(ctx, dc.MaxDuration)
+func download(ctx context.Context, dc config) (result errWithPermanence) {
+	cancel := context.CancelFunc(func() {})
+	if dc.MaxDuration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, dc.MaxDuration)
+	}
 	defer cancel()
 
+	// Count what came of the attempt: new, duplicate, not-modified or
+	// failed. Dry runs are not counted.
+	outcome := ""
+	defer func() {
+		// Every attempt, however it ends, shows the run isn't stuck.
+		scheduler.Heartbeat(ctx)
+		if dc.DryRun != nil {
+			return
+		}
+		if result.error != nil {
+			outcome = "failed"
+		}
+		if outcome != "" {
+			metrics.DownloadOutcomeCount.With(prometheus.Labels{"dataset": dc.Dataset, "outcome": outcome}).Inc()
+		}
+	}()
+	observe := func(h *prometheus.HistogramVec, value float64) {
+		if dc.DryRun == nil {
+			h.With(prometheus.Labels{"dataset": dc.Dataset}).Observe(value)
+		}
+	}
+
 	// Grab the file from the website.
-	req, err := http.NewRequest(http.MethodGet, dc.URL, nil)
+	// The request is bound to ctx, so that a hung server or a stuck body
+	// can't outlive MaxDuration, a shutdown or a cancel.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dc.URL, nil)
 	if err != nil {
 		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Web Get"}).Inc()
 		return errWithPermanence{err, false}
@@ -76,12 +147,52 @@ func download(ctx context.Context, dc config) errWithPermanence {
 		req.SetBasicAuth(dc.BasicAuthUser, dc.BasicAuthPass)
 	}
 
+	// If we fetched this URL before, only fetch it again if it changed.
+	var validators *httpValidators
+	if dc.Conditional {
+		validators, err = loadHTTPValidators(ctx, dc.Store, dc.URL)
+		if err != nil {
+			// An unconditional GET is slower, but still correct.
+			metrics.DownloaderErrorCount.
+				With(prometheus.Labels{"source": "Validator Load Error"}).Inc()
+		} else if validators != nil {
+			validators.setConditionalHeaders(req)
+		}
+	}
+
 	client := http.Client{}
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
 		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Web Get"}).Inc()
 		return errWithPermanence{err, false}
 	}
+	observe(metrics.HTTPTimeToFirstByte, time.Since(start).Seconds())
+
+	// Nothing changed since the last time we fetched this URL.
+	if dc.Conditional && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		outcome = "not-modified"
+		if dc.DryRun != nil {
+			dc.DryRun.Outcome = PlannedNotModified
+			return errWithPermanence{}
+		}
+		if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+			trackLastModified(dc, lastModified)
+		} else if validators != nil {
+			trackLastModified(dc, validators.LastModified)
+		}
+		return errWithPermanence{}
+	}
+
+	// There is no such file, and that's fine.
+	if dc.MissingOK && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		if dc.DryRun != nil {
+			dc.DryRun.Outcome = PlannedMissing
+		}
+		return errWithPermanence{}
+	}
 
 	// Ensure that the webserver thinks our file request was okay
 	if resp.StatusCode != http.StatusOK {
@@ -91,6 +202,17 @@ func download(ctx context.Context, dc config) errWithPermanence {
 		return errWithPermanence{errors.New("URL:" + dc.URL + " gave response code " + resp.Status), false}
 	}
 
+	// Fetch the checksum the file has to match, if it has one.
+	var wantSHA256 []byte
+	if dc.ChecksumURL != "" {
+		wantSHA256, err = fetchChecksum(ctx, dc)
+		if err != nil {
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Checksum Error"}).Inc()
+			resp.Body.Close()
+			return errWithPermanence{err, false}
+		}
+	}
+
 	// Get a handle on our object in GCS where we will store the file
 	var filename string
 	if dc.FixedFilename != "" {
@@ -100,37 +222,262 @@ func download(ctx context.Context, dc config) errWithPermanence {
 		filename = dc.PathPrefix + urlMatches[0][1] + dc.FilePrefix + urlMatches[0][2]
 	}
 	obj := dc.Store.GetFile(filename)
-	w := obj.GetWriter(ctx)
+	var w file.Writer = discardWriter{}
+	if dc.DryRun == nil {
+		w = obj.GetWriter(ctx)
+	}
 
-	// Move the file into GCS
-	if _, err = io.Copy(w, resp.Body); err != nil {
+	// Stream the file into GCS, hashing it on the way. Nothing is
+	// visible in GCS until we decide to commit it below. Reading from the
+	// network and writing to the store are timed apart, to tell which is
+	// slow.
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	body := &timedReader{r: resp.Body}
+	stored := &timedWriter{w: w}
+	size, err := io.Copy(io.MultiWriter(stored, md5Hash, sha256Hash), body)
+	resp.Body.Close()
+	if err != nil {
+		w.Abort()
 		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Copy Error"}).Inc()
 		return errWithPermanence{err, false}
 	}
-	w.Close()
-	resp.Body.Close()
+	observe(metrics.TransferDuration, body.elapsed.Seconds())
+	observe(metrics.TransferBytes, float64(size))
+	if body.elapsed > 0 {
+		observe(metrics.TransferThroughput, float64(size)/body.elapsed.Seconds())
+	}
+
+	// A file that doesn't match its checksum is never stored or promoted.
+	if wantSHA256 != nil && !bytes.Equal(sha256Hash.Sum(nil), wantSHA256) {
+		w.Abort()
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Checksum Error"}).Inc()
+		return errWithPermanence{errors.New("URL:" + dc.URL + " does not match the SHA-256 in " + dc.ChecksumURL), false}
+	}
 
-	// If we downloaded a new file, save it to current.  If it wasn't new, delete it.
-	if IsFileNew(ctx, dc.Store, filename, dc.DedupRegexp.FindAllStringSubmatch(filename, -1)[0][1]) {
-		if dc.CurrentName != "" {
-			err = obj.CopyTo(ctx, dc.CurrentName)
-			if err != nil {
-				metrics.DownloaderErrorCount.
-					With(prometheus.Labels{"source": "Copy to Current Error"}).Inc()
-				return errWithPermanence{err, true}
+	// If the file is a duplicate, never commit it. If we can't tell,
+	// don't commit it either, and try again.
+	searchDir := dc.DedupRegexp.FindAllStringSubmatch(filename, -1)[0][1]
+	var isNew bool
+	if dc.DryRun == nil {
+		start = time.Now()
+		isNew, err = IsFileNew(ctx, dc.Store, filename, md5Hash.Sum(nil), searchDir)
+		observe(metrics.DedupCheckDuration, time.Since(start).Seconds())
+	} else {
+		var index *digestIndex
+		if index, _, err = readDigestIndex(ctx, dc.Store, searchDir); err == nil {
+			isNew = CheckIfHashIsUniqueInList(md5Hash.Sum(nil), index.md5s(), filename)
+		}
+	}
+	if err != nil {
+		w.Abort()
+		metrics.DownloaderErrorCount.
+			With(prometheus.Labels{"source": "Duplication Check Error"}).Inc()
+		return errWithPermanence{err, false}
+	}
+	if dc.DryRun != nil {
+		dc.DryRun.Object = filename
+		dc.DryRun.Outcome = PlannedDuplicate
+		if isNew {
+			dc.DryRun.Outcome = PlannedNew
+			dc.DryRun.CurrentName = dc.CurrentName
+		}
+		return errWithPermanence{}
+	}
+	if !isNew {
+		outcome = "duplicate"
+		if err = w.Abort(); err != nil {
+			// The duplicate was still never committed, so this only costs storage.
+			metrics.DownloaderErrorCount.
+				With(prometheus.Labels{"source": "Duplication Abort Error"}).Inc()
+		}
+		trackLastModified(dc, resp.Header.Get("Last-Modified"))
+		rememberValidators(ctx, dc, resp)
+		return errWithPermanence{}
+	}
+
+	// Nor if it was rejected already, and is waiting in quarantine for a
+	// person to look at it.
+	if dc.Dataset != "" {
+		quarantined, err := findQuarantined(ctx, dc.Store, dc.Dataset, md5Hash.Sum(nil))
+		if err != nil {
+			w.Abort()
+			metrics.DownloaderErrorCount.
+				With(prometheus.Labels{"source": "Duplication Check Error"}).Inc()
+			return errWithPermanence{err, false}
+		}
+		if quarantined != "" {
+			log.Println("Skipping", filename, "because it is already in quarantine as", quarantined)
+			outcome = "duplicate"
+			w.Abort()
+			rememberValidators(ctx, dc, resp)
+			return errWithPermanence{}
+		}
+	}
+	start = time.Now()
+	if err = w.Close(); err != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Upload Error"}).Inc()
+		return errWithPermanence{err, false}
+	}
+	// The upload is the writes to the store while streaming, and the commit.
+	observe(metrics.UploadDuration, (stored.elapsed + time.Since(start)).Seconds())
+
+	// Never promote a file that is unfit for use, quarantine it instead.
+	// The next attempt is left to the next scheduled run. If it can't be
+	// quarantined it mustn't stay in the archive either, where it would be
+	// mistaken for a good file, so it is deleted and the download retried.
+	reject := func(reason error, stats *VersionStats) errWithPermanence {
+		log.Println("Quarantining", filename, "because", reason)
+		q := &Quarantined{
+			Reason:      reason.Error(),
+			Headers:     resp.Header,
+			MD5:         hex.EncodeToString(md5Hash.Sum(nil)),
+			Stats:       stats,
+			ArchiveName: filename,
+			DedupDir:    searchDir,
+		}
+		if err := quarantine(ctx, dc, obj, q); err != nil {
+			log.Println("Couldn't quarantine", filename, err)
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Quarantine Error"}).Inc()
+			obj.DeleteFile(ctx)
+			return errWithPermanence{err, false}
+		}
+		return errWithPermanence{quarantinedError{reason}, true}
+	}
+	if err = validateFile(ctx, dc, obj); err != nil {
+		if _, invalid := err.(invalidFileError); !invalid {
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Validation Read Error"}).Inc()
+			obj.DeleteFile(ctx)
+			return errWithPermanence{err, false}
+		}
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Validation Error"}).Inc()
+		return reject(err, nil)
+	}
+
+	// Nor one that is suspiciously different from the version before it.
+	stats, err := versionStats(ctx, dc, obj, filename, size)
+	if err != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Version Stats Error"}).Inc()
+		obj.DeleteFile(ctx)
+		return errWithPermanence{err, false}
+	}
+	if dc.Dataset != "" && !dc.Backfill {
+		history, err := loadVersionHistory(ctx, dc.Store, dc.Dataset)
+		if err != nil {
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Version Stats Error"}).Inc()
+			obj.DeleteFile(ctx)
+			return errWithPermanence{err, false}
+		}
+		if err = checkDeltas(dc.Dataset, history.latest(), stats, dc.MaxDeltaPercent); err != nil {
+			if !dc.Force {
+				metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Version Delta Error"}).Inc()
+				return reject(err, stats)
 			}
+			log.Println("Forcing", filename, "although", err)
 		}
-	} else {
-		err = obj.DeleteFile(ctx)
+	}
+
+	// We kept a new file, so save it to current.
+	if dc.CurrentName != "" {
+		start = time.Now()
+		err = obj.CopyTo(ctx, dc.CurrentName)
 		if err != nil {
 			metrics.DownloaderErrorCount.
-				With(prometheus.Labels{"source": "Duplication Deletion Error"}).Inc()
+				With(prometheus.Labels{"source": "Copy to Current Error"}).Inc()
 			return errWithPermanence{err, true}
 		}
+		observe(metrics.CopyToDuration, time.Since(start).Seconds())
+	}
+	if err = addToDigestIndex(ctx, dc.Store, searchDir, filename, md5Hash.Sum(nil)); err != nil {
+		metrics.DownloaderErrorCount.
+			With(prometheus.Labels{"source": "Digest Index Error"}).Inc()
+		return errWithPermanence{err, true}
 	}
+	if dc.Dataset != "" && !dc.Backfill {
+		if err = addToVersionHistory(ctx, dc.Store, dc.Dataset, *stats); err != nil {
+			// The next version will be compared with an older one.
+			metrics.DownloaderErrorCount.
+				With(prometheus.Labels{"source": "Version Stats Error"}).Inc()
+		}
+	}
+	outcome = "new"
+	if !dc.Backfill {
+		trackKept(dc.Dataset, filename, dc.CurrentName)
+	}
+	trackLastModified(dc, resp.Header.Get("Last-Modified"))
+	notifyNewFile(ctx, dc, notify.NewFile{
+		Dataset: dc.Dataset,
+		Object:  filename,
+		Size:    size,
+		MD5:     hex.EncodeToString(md5Hash.Sum(nil)),
+		URL:     dc.URL,
+	})
+	rememberValidators(ctx, dc, resp)
 	return errWithPermanence{}
 }
 
+// trackLastModified records lastModified, a Last-Modified header of
+// dc.URL, as when the newest file of dc's dataset was published, if dc
+// says that it is.
+func trackLastModified(dc config, lastModified string) {
+	if !dc.LastModifiedIsPublished || dc.Backfill || lastModified == "" {
+		return
+	}
+	published, err := http.ParseTime(lastModified)
+	if err != nil {
+		return
+	}
+	trackPublished(dc.Dataset, published)
+}
+
+// invalidFileError is the reason a file failed validation.
+type invalidFileError struct {
+	error
+}
+
+// validateFile runs dc.Validators on obj. If obj fails one, it returns an
+// invalidFileError. Any other error means obj couldn't be read.
+func validateFile(ctx context.Context, dc config, obj file.Object) error {
+	for _, validate := range dc.Validators {
+		r, err := obj.GetReader(ctx)
+		if err != nil {
+			return err
+		}
+		err = validate(r)
+		r.Close()
+		if err != nil {
+			return invalidFileError{err}
+		}
+	}
+	return nil
+}
+
+// rememberValidators saves the validators of a successfully handled
+// response if dc asks for conditional GETs. Failing to save them only
+// means the next fetch is unconditional, so it is not an error.
+func rememberValidators(ctx context.Context, dc config, resp *http.Response) {
+	if !dc.Conditional {
+		return
+	}
+	if err := saveHTTPValidators(ctx, dc.Store, dc.URL, resp); err != nil {
+		log.Println("Couldn't save validators for", dc.URL, err)
+		metrics.DownloaderErrorCount.
+			With(prometheus.Labels{"source": "Validator Save Error"}).Inc()
+	}
+}
+
+// notifyNewFile tells dc.Notifier, if there is one, about a new file. The
+// file is already kept, so failing to notify is not an error.
+func notifyNewFile(ctx context.Context, dc config, f notify.NewFile) {
+	if dc.Notifier == nil {
+		return
+	}
+	if err := dc.Notifier.Notify(ctx, f); err != nil {
+		log.Println("Couldn't notify about", f.Object, err)
+		metrics.DownloaderErrorCount.
+			With(prometheus.Labels{"source": "Notification Error"}).Inc()
+	}
+}
+
 type errWithPermanence struct {
 	error
 	permanent bool
@@ -143,37 +490,40 @@ type errWithPermanence struct {
 // encountered an unrecoverable error. It also takes a retryTimeMin to
 // wait after the first failure before retrying. After each failure,
 // it will wait twice as long until it reaches the retryTimeMax, which
-// makes it return the last error it encountered.
+// makes it return the last error it encountered. If ctx is done while
+// waiting, it gives up right away and returns ctx.Err().
 func runFunctionWithRetry(ctx context.Context, function func(context.Context, config) errWithPermanence, config config,
 	retryTimeMin time.Duration, retryTimeMax time.Duration) error {
 
 	retryTime := retryTimeMin
-	for err := function(ctx, config); err.error != nil && ctx.Err() == nil; err = function(ctx, config) {
+	for err := function(ctx, config); err.error != nil; err = function(ctx, config) {
 		log.Printf("Download failed: %+v\n", err)
 		if err.permanent || retryTime > retryTimeMax {
 			return err.error
 		}
-		time.Sleep(retryTime)
+		if serr := scheduler.Sleep(ctx, retryTime); serr != nil {
+			return serr
+		}
 		retryTime = retryTime * 2
 	}
 	return nil
 }
 
-// IsFileNew takes an implementation of the FileStore
-// interface, a filename, and a search dir and determines if any of
-// the files in the search dir are duplicates of the file given by
-// filename. If there is a duplicate then the file is not new and it
-// returns false. If there is not duplicate (or if we are unsure, just
-// to be safe) we return true, indicating that the file might be new
-// and should be kept.
-func IsFileNew(ctx context.Context, store file.Store, fileName string, searchDir string) bool {
-	md5Hash, ok := store.NamesToMD5(ctx, fileName)[fileName]
-	if !ok {
-		log.Println("Couldn't find file for hash generation!!!")
-		return true
+// IsFileNew takes an implementation of the file.Store interface, a
+// filename, its MD5 hash, and a search dir and determines if any of
+// the files recorded in the search dir's digest index are duplicates
+// of the file given by filename. If there is a duplicate then the file
+// is not new and it returns false. If there is no duplicate it returns
+// true. The file does not need to be in the store yet. If we are
+// unsure, because the index could not be read, it returns an error and
+// the boolean is meaningless, so the caller can decide what to do
+// instead of us guessing.
+func IsFileNew(ctx context.Context, store file.Store, fileName string, md5Hash []byte, searchDir string) (bool, error) {
+	index, err := loadDigestIndex(ctx, store, searchDir)
+	if err != nil {
+		return false, err
 	}
-	md5Map := store.NamesToMD5(ctx, searchDir)
-	return CheckIfHashIsUniqueInList(md5Hash, md5Map, fileName)
+	return CheckIfHashIsUniqueInList(md5Hash, index.md5s(), fileName), nil
 }
 
 // CheckIfHashIsUniqueInList takes an MD5 hash, a map of names to MD5
@@ -188,3 +538,29 @@ func CheckIfHashIsUniqueInList(md5Hash []byte, md5Map map[string][]byte, fileNam
 	}
 	return true
 }
+
+// timedReader adds up the time spent reading from r.
+type timedReader struct {
+	r       io.Reader
+	elapsed time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	t.elapsed += time.Since(start)
+	return n, err
+}
+
+// timedWriter adds up the time spent writing to w.
+type timedWriter struct {
+	w       io.Writer
+	elapsed time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	t.elapsed += time.Since(start)
+	return n, err
+}
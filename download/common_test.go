@@ -3,18 +3,24 @@ package download
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/m-lab/downloader/file"
+	"github.com/m-lab/downloader/metrics"
+	"github.com/m-lab/downloader/notify"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 //// implementation of API purely for testing purposes
@@ -31,15 +37,35 @@ func (fsto *testStore) GetFile(name string) file.Object {
 	return &testFileObject{name: name, md5: nil, data: bytes.NewBuffer(nil), fsto: fsto}
 }
 
-func (fsto *testStore) NamesToMD5(_ context.Context, prefix string) map[string][]byte {
-	attrMap := make(map[string][]byte)
+func (fsto *testStore) List(_ context.Context, prefix string) file.ObjectIterator {
+	it := &testIterator{}
 	for key, object := range fsto.files {
 		if strings.HasPrefix(key, prefix) {
-			attrMap[key] = object.md5
+			it.attrs = append(it.attrs, &file.ObjectAttrs{Name: key, MD5: object.md5})
 		}
 	}
-	return attrMap
+	if strings.HasSuffix(prefix, "listFail") {
+		it.err = errors.New("Example List Error")
+	}
+	return it
+}
+
+//// testIterator returns a fixed list of objects, then err or file.Done
+type testIterator struct {
+	attrs []*file.ObjectAttrs
+	err   error
+}
 
+func (it *testIterator) Next() (*file.ObjectAttrs, error) {
+	if len(it.attrs) == 0 {
+		if it.err != nil {
+			return nil, it.err
+		}
+		return nil, file.Done
+	}
+	attrs := it.attrs[0]
+	it.attrs = it.attrs[1:]
+	return attrs, nil
 }
 
 //// Obj struct implements both the attrs and the object interfaces for testing
@@ -51,32 +77,64 @@ type testFileObject struct {
 	copied bool
 }
 
-func (file *testFileObject) GetWriter(_ context.Context) io.WriteCloser {
-	return file
-}
-
-func (file *testFileObject) Write(p []byte) (n int, err error) {
-	if strings.HasSuffix(file.name, "copyFail") {
-		return 0, errors.New("Example Copy Error")
+func (obj *testFileObject) GetReader(_ context.Context) (io.ReadCloser, error) {
+	if obj.fsto == nil || obj.fsto.files[obj.name] != obj {
+		return nil, file.ErrNotExist
 	}
-	return file.data.Write(p)
+	if obj.data == nil {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return io.NopCloser(bytes.NewReader(obj.data.Bytes())), nil
 }
 
-func (file *testFileObject) Close() error {
-	file.md5 = []byte("NEW FILE")
-	file.fsto.files[file.name] = file
-	return nil
+func (file *testFileObject) GetWriter(_ context.Context) file.Writer {
+	return &testWriter{file: file, buf: bytes.NewBuffer(nil)}
 }
 
 func (file *testFileObject) DeleteFile(_ context.Context) error {
 	if strings.HasSuffix(file.name, "deleteFail") {
 		return errors.New("couldn't delete file")
 	}
+	delete(file.fsto.files, file.name)
 	return nil
 }
 
 func (file *testFileObject) CopyTo(_ context.Context, filename string) error {
+	if strings.HasPrefix(filename, quarantinePrefix) && strings.HasSuffix(filename, "quarantineFail") {
+		return errors.New("Example Quarantine Error")
+	}
 	file.copied = true
+	file.fsto.files[filename] = &testFileObject{name: filename, md5: file.md5, data: file.data, fsto: file.fsto}
+	return nil
+}
+
+//// testWriter only adds its data to the store when it is closed
+type testWriter struct {
+	file    *testFileObject
+	buf     *bytes.Buffer
+	aborted bool
+}
+
+func (w *testWriter) Write(p []byte) (n int, err error) {
+	if strings.HasSuffix(w.file.name, "copyFail") {
+		return 0, errors.New("Example Copy Error")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *testWriter) Close() error {
+	if w.aborted {
+		return errors.New("Close after Abort")
+	}
+	sum := md5.Sum(w.buf.Bytes())
+	w.file.md5 = sum[:]
+	w.file.data = w.buf
+	w.file.fsto.files[w.file.name] = w.file
+	return nil
+}
+
+func (w *testWriter) Abort() error {
+	w.aborted = true
 	return nil
 }
 
@@ -143,17 +201,15 @@ func TestDownload(t *testing.T) {
 		},
 		{
 			dc: config{
-				URL: "Fill me",
-				Store: &testStore{map[string]*testFileObject{
-					"pre/file.del/dup": {name: "pre/file.del/dup", data: bytes.NewBuffer(nil), md5: []byte("NEW FILE")},
-				}},
+				URL:         "Fill me",
+				Store:       &testStore{map[string]*testFileObject{}},
 				PathPrefix:  "pre/",
 				URLRegexp:   regexp.MustCompile(`.*()(/.*)`),
-				DedupRegexp: regexp.MustCompile(`(pre/)`),
+				DedupRegexp: regexp.MustCompile(`(.*)`),
 			},
-			postfix: "/file.deleteFail",
-			resBool: true,
-			resErr:  errors.New("Couldn't Delete File"),
+			postfix: "/file.success",
+			resBool: false,
+			resErr:  nil,
 		},
 		{
 			dc: config{
@@ -163,9 +219,9 @@ func TestDownload(t *testing.T) {
 				URLRegexp:   regexp.MustCompile(`.*()(/.*)`),
 				DedupRegexp: regexp.MustCompile(`(.*)`),
 			},
-			postfix: "/file.success",
+			postfix: "/file.listFail",
 			resBool: false,
-			resErr:  nil,
+			resErr:  errors.New("Duplication check error"),
 		},
 	}
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -187,6 +243,183 @@ func TestDownload(t *testing.T) {
 
 }
 
+// testNotifier records the files it is told about.
+type testNotifier struct {
+	files []notify.NewFile
+}
+
+func (n *testNotifier) Notify(_ context.Context, f notify.NewFile) error {
+	n.files = append(n.files, f)
+	return nil
+}
+
+func TestDownloadSkipsDuplicates(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Stuff")
+	}))
+	defer ts.Close()
+	stuffMD5 := md5.Sum([]byte("Stuff"))
+	fs := &testStore{map[string]*testFileObject{
+		"pre/old": {name: "pre/old", data: bytes.NewBufferString("Stuff"), md5: stuffMD5[:]},
+	}}
+	dc := config{
+		URL:         ts.URL + "/file.dup",
+		Store:       fs,
+		PathPrefix:  "pre",
+		CurrentName: "pre/current",
+		URLRegexp:   regexp.MustCompile(`.*()(/.*)`),
+		DedupRegexp: regexp.MustCompile(`(pre/)`),
+		MaxDuration: time.Minute,
+		Dataset:     "test",
+		Notifier:    &testNotifier{},
+	}
+	if err := download(context.Background(), dc); err.error != nil {
+		t.Fatalf("download() returned %v", err)
+	}
+	if n := dc.Notifier.(*testNotifier); len(n.files) != 0 {
+		t.Errorf("The duplicate was notified: %v", n.files)
+	}
+	if _, ok := fs.files["pre/file.dup"]; ok {
+		t.Error("The duplicate was written to the store")
+	}
+	if _, ok := fs.files["pre/current"]; ok {
+		t.Error("The duplicate was copied to current")
+	}
+
+	// A new file is written, copied to current and added to the index.
+	dc.URL = ts.URL + "/file.new"
+	fs.files = map[string]*testFileObject{}
+	if err := download(context.Background(), dc); err.error != nil {
+		t.Fatalf("download() returned %v", err)
+	}
+	if _, ok := fs.files["pre/file.new"]; !ok {
+		t.Error("The new file was not written to the store")
+	}
+	if _, ok := fs.files["pre/current"]; !ok {
+		t.Error("The new file was not copied to current")
+	}
+	index, err := loadDigestIndex(context.Background(), fs, "pre/")
+	if err != nil || index.Objects["pre/file.new"] != fmt.Sprintf("%x", stuffMD5) {
+		t.Errorf("The digest index was not updated: %+v, %v", index, err)
+	}
+	want := []notify.NewFile{{
+		Dataset: "test",
+		Object:  "pre/file.new",
+		Size:    5,
+		MD5:     fmt.Sprintf("%x", stuffMD5),
+		URL:     dc.URL,
+	}}
+	if n := dc.Notifier.(*testNotifier); !reflect.DeepEqual(n.files, want) {
+		t.Errorf("Notified %+v, expected %+v", n.files, want)
+	}
+}
+
+func TestDownloadConditional(t *testing.T) {
+	body := "Stuff"
+	fullGets := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"%x"`, md5.Sum([]byte(body)))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullGets++
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Tue, 01 Jun 2021 00:00:00 GMT")
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+	dc := config{
+		URL:           ts.URL + "/download?suffix=tar.gz",
+		Store:         fs,
+		PathPrefix:    "pre/",
+		FixedFilename: "file.tar.gz",
+		CurrentName:   "pre/current",
+		DedupRegexp:   regexp.MustCompile(`(pre/)`),
+		MaxDuration:   time.Minute,
+		Conditional:   true,
+	}
+	for i := 0; i < 3; i++ {
+		if err := download(context.Background(), dc); err.error != nil {
+			t.Fatalf("download() returned %v", err)
+		}
+	}
+	if fullGets != 1 {
+		t.Errorf("Expected 1 full GET, got %d", fullGets)
+	}
+	v, err := loadHTTPValidators(context.Background(), fs, dc.URL)
+	if err != nil || v == nil || v.LastModified != "Tue, 01 Jun 2021 00:00:00 GMT" {
+		t.Errorf("Validators not saved: %+v, %v", v, err)
+	}
+
+	// Once the content changes, it is fetched and the validators are replaced.
+	body = "New Stuff"
+	dc.FixedFilename = "file2.tar.gz"
+	if err := download(context.Background(), dc); err.error != nil {
+		t.Fatalf("download() returned %v", err)
+	}
+	if fullGets != 2 {
+		t.Errorf("Expected 2 full GETs, got %d", fullGets)
+	}
+	if _, ok := fs.files["pre/file2.tar.gz"]; !ok {
+		t.Error("The changed file was not saved")
+	}
+	v, _ = loadHTTPValidators(context.Background(), fs, dc.URL)
+	if v == nil || v.ETag != fmt.Sprintf(`"%x"`, md5.Sum([]byte(body))) {
+		t.Errorf("Validators not updated: %+v", v)
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	body := "Stuff"
+	checksum := fmt.Sprintf("%x  GeoLite2-City.tar.gz\n", sha256.Sum256([]byte(body)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("suffix") {
+		case "tar.gz":
+			fmt.Fprint(w, body)
+		case "tar.gz.sha256":
+			fmt.Fprint(w, checksum)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	tests := []struct {
+		name        string
+		body        string
+		checksumURL string
+		willErr     bool
+	}{
+		{name: "match", body: "Stuff", checksumURL: ts.URL + "/?suffix=tar.gz.sha256"},
+		{name: "mismatch", body: "Corrupted Stuff", checksumURL: ts.URL + "/?suffix=tar.gz.sha256", willErr: true},
+		{name: "no checksum", body: "Stuff", checksumURL: ts.URL + "/?suffix=missing", willErr: true},
+	}
+	for _, test := range tests {
+		body = test.body
+		fs := &testStore{map[string]*testFileObject{}}
+		dc := config{
+			URL:           ts.URL + "/?suffix=tar.gz",
+			ChecksumURL:   test.checksumURL,
+			Store:         fs,
+			PathPrefix:    "pre/",
+			FixedFilename: "file.tar.gz",
+			CurrentName:   "pre/current",
+			DedupRegexp:   regexp.MustCompile(`(pre/)`),
+			MaxDuration:   time.Minute,
+		}
+		err := download(context.Background(), dc)
+		if (err.error != nil) != test.willErr {
+			t.Errorf("%s: download() returned %v, expected error %t", test.name, err.error, test.willErr)
+		}
+		_, stored := fs.files["pre/file.tar.gz"]
+		_, promoted := fs.files["pre/current"]
+		if stored == test.willErr || promoted == test.willErr {
+			t.Errorf("%s: stored %t and promoted %t, expected %t", test.name, stored, promoted, !test.willErr)
+		}
+	}
+}
+
 type retryTest struct {
 	force    bool
 	numError int
@@ -255,70 +488,122 @@ func TestRunFunctionWithRetry(t *testing.T) {
 
 }
 
+func TestRunFunctionWithRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	fail := func(context.Context, config) errWithPermanence {
+		calls++
+		cancel()
+		return errWithPermanence{errors.New("runFunction Error"), false}
+	}
+	start := time.Now()
+	err := runFunctionWithRetry(ctx, fail, config{}, time.Hour, 8*time.Hour)
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("runFunctionWithRetry() = %v after %d calls, expected %v after 1", err, calls, context.Canceled)
+	}
+	if time.Since(start) > time.Minute {
+		t.Error("runFunctionWithRetry() waited after its context was canceled")
+	}
+}
+
+// withIndex adds a digest index object for searchDir to the store.
+func withIndex(fs *testStore, searchDir string, contents string) *testStore {
+	name := digestIndexName(searchDir)
+	fs.files[name] = &testFileObject{name: name, data: bytes.NewBufferString(contents), fsto: fs}
+	return fs
+}
+
 func TestIsFileNew(t *testing.T) {
 	tests := []struct {
 		fs        *testStore
 		directory string
 		filename  string
+		md5       []byte
 		res       bool
+		willErr   bool
 	}{
 		{
 			fs: &testStore{map[string]*testFileObject{
-				"search/unique":     {name: "search/unique", data: nil, md5: []byte("123")},
 				"search/thing":      {name: "search/thing", data: nil, md5: []byte("000")},
 				"search/stuff":      {name: "search/stuff", data: nil, md5: []byte("765")},
 				"otherDir/ignoreMe": {name: "otherDir/ignoreMe", data: nil, md5: []byte("123")},
 			}},
 			directory: "search/",
 			filename:  "search/unique",
+			md5:       []byte("123"),
 			res:       true,
 		},
 		{
 			fs: &testStore{map[string]*testFileObject{
-				"search/unique":     {name: "search/unique", data: nil, md5: []byte("123")},
 				"search/thing":      {name: "search/thing", data: nil, md5: []byte("000")},
 				"search/stuff":      {name: "search/stuff", data: nil, md5: []byte("123")},
 				"otherDir/ignoreMe": {name: "otherDir/ignoreMe", data: nil, md5: []byte("765")},
 			}},
 			directory: "search/",
 			filename:  "search/unique",
+			md5:       []byte("123"),
 			res:       false,
 		},
 		{
 			fs: &testStore{map[string]*testFileObject{
-				"search/unique":     {name: "search/unique", data: nil, md5: []byte("123")},
-				"search/thing":      {name: "search/thing", data: nil, md5: []byte("000")},
-				"search/stuff":      {name: "search/stuff", data: nil, md5: []byte("765")},
-				"otherDir/ignoreMe": {name: "otherDir/ignoreMe", data: nil, md5: []byte("123")},
+				"search/unique": {name: "search/unique", data: nil, md5: []byte("123")},
+				"search/thing":  {name: "search/thing", data: nil, md5: []byte("000")},
 			}},
 			directory: "search/",
-			filename:  "otherDir/ignoreMe",
-			res:       false,
+			filename:  "search/unique",
+			md5:       []byte("123"),
+			res:       true,
 		},
 		{
 			fs: &testStore{map[string]*testFileObject{
-				"search/unique":     {name: "search/unique", data: nil, md5: nil},
-				"search/thing":      {name: "search/thing", data: nil, md5: []byte("000")},
-				"search/stuff":      {name: "search/stuff", data: nil, md5: []byte("765")},
-				"otherDir/ignoreMe": {name: "otherDir/ignoreMe", data: nil, md5: []byte("123")},
+				"search/unique": {name: "search/unique", data: nil, md5: nil},
+				"search/thing":  {name: "search/thing", data: nil, md5: []byte("000")},
 			}},
 			directory: "search/",
+			filename:  "search/other",
+			md5:       []byte("000"),
+			res:       false,
+		},
+		{
+			// The index is trusted over the contents of the directory.
+			fs: withIndex(&testStore{map[string]*testFileObject{
+				"search/thing": {name: "search/thing", data: nil, md5: []byte("123")},
+			}}, "search/", `{"objects": {"search/old": "373635"}}`),
+			directory: "search/",
 			filename:  "search/unique",
-			res:       true,
+			md5:       []byte("765"),
+			res:       false,
+		},
+		{
+			fs:        withIndex(&testStore{map[string]*testFileObject{}}, "search/", `not json`),
+			directory: "search/",
+			filename:  "search/unique",
+			md5:       []byte("765"),
+			willErr:   true,
 		},
 		{
 			fs: &testStore{map[string]*testFileObject{
 				"otherDir/ignoreMe": {name: "otherDir/ignoreMe", data: nil, md5: []byte("123")},
 			}},
-			directory: "search/",
+			directory: "search/listFail",
 			filename:  "otherDir/ignoreMe",
-			res:       true,
+			md5:       []byte("123"),
+			willErr:   true,
 		},
 	}
 	for _, test := range tests {
-		res := IsFileNew(context.Background(), test.fs, test.filename, test.directory)
-		if res != test.res {
-			t.Errorf("Expected %t, got %t for %+v.", test.res, res, test)
+		res, err := IsFileNew(context.Background(), test.fs, test.filename, test.md5, test.directory)
+		if test.willErr {
+			if err == nil {
+				t.Errorf("Expected error, got nil for %+v.", test)
+			}
+			continue
+		}
+		if err != nil || res != test.res {
+			t.Errorf("Expected %t, got %t, %v for %+v.", test.res, res, err, test)
+		}
+		if _, ok := test.fs.files[digestIndexName(test.directory)]; !ok {
+			t.Errorf("The digest index for %s was not saved", test.directory)
 		}
 	}
 
@@ -413,3 +698,172 @@ func assertErrWithPermanenceIsAnError(e errWithPermanence) error {
 func assertErrWithPermanencePointerIsAnError(e *errWithPermanence) error {
 	return e
 }
+
+func TestDownloadMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"stuff"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"stuff"`)
+		fmt.Fprint(w, "Stuff")
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+	dc := config{
+		URL:           ts.URL + "/download",
+		Store:         fs,
+		PathPrefix:    "pre/",
+		FixedFilename: "file.tar.gz",
+		CurrentName:   "pre/current",
+		DedupRegexp:   regexp.MustCompile(`(pre/)`),
+		MaxDuration:   time.Minute,
+		Conditional:   true,
+		Dataset:       "MetricsTest",
+	}
+	// New, then not modified.
+	for i := 0; i < 2; i++ {
+		if err := download(context.Background(), dc); err.error != nil {
+			t.Fatal(err)
+		}
+	}
+	// A duplicate.
+	dc.Conditional = false
+	dc.FixedFilename = "file2.tar.gz"
+	if err := download(context.Background(), dc); err.error != nil {
+		t.Fatal(err)
+	}
+	// A failure.
+	dc.URL = ts.URL + "/missing"
+	if err := download(context.Background(), dc); err.error == nil {
+		t.Fatal("download() of a missing file succeeded")
+	}
+
+	for _, outcome := range []string{"new", "not-modified", "duplicate", "failed"} {
+		samples, err := metrics.Gather("downloader_download_outcomes_total", prometheus.Labels{"dataset": "MetricsTest", "outcome": outcome})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != 1 || samples[0].Value != 1 {
+			t.Errorf("The %s outcomes are %+v, expected one", outcome, samples)
+		}
+	}
+	// Each is observed once per file transferred, uploaded or copied.
+	for name, count := range map[string]uint64{
+		"downloader_http_ttfb_seconds":                    4,
+		"downloader_transfer_duration_seconds":            2,
+		"downloader_transfer_bytes":                       2,
+		"downloader_transfer_throughput_bytes_per_second": 2,
+		"downloader_dedup_check_duration_seconds":         2,
+		"downloader_upload_duration_seconds":              1,
+		"downloader_copy_to_duration_seconds":             1,
+	} {
+		samples, err := metrics.Gather(name, prometheus.Labels{"dataset": "MetricsTest"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != 1 || samples[0].Count != count {
+			t.Errorf("%s is %+v, expected %d observations", name, samples, count)
+		}
+	}
+	if samples, _ := metrics.Gather("downloader_transfer_bytes", prometheus.Labels{"dataset": "MetricsTest"}); len(samples) == 1 && samples[0].Value != 10 {
+		t.Errorf("downloader_transfer_bytes sums to %v, expected 10", samples[0].Value)
+	}
+}
+
+// slowWriteStore is a testStore whose writes take a while.
+type slowWriteStore struct {
+	*testStore
+}
+
+func (fsto slowWriteStore) GetFile(name string) file.Object {
+	return slowWriteObject{fsto.testStore.GetFile(name).(*testFileObject)}
+}
+
+type slowWriteObject struct {
+	*testFileObject
+}
+
+func (o slowWriteObject) GetWriter(ctx context.Context) file.Writer {
+	return slowWriter{o.testFileObject.GetWriter(ctx)}
+}
+
+type slowWriter struct {
+	file.Writer
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(50 * time.Millisecond)
+	return w.Writer.Write(p)
+}
+
+func TestDownloadTimesStoreApart(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Stuff")
+	}))
+	defer ts.Close()
+	dc := config{
+		URL:           ts.URL + "/download",
+		Store:         slowWriteStore{&testStore{map[string]*testFileObject{}}},
+		PathPrefix:    "pre/",
+		FixedFilename: "file.tar.gz",
+		DedupRegexp:   regexp.MustCompile(`(pre/)`),
+		MaxDuration:   time.Minute,
+		Dataset:       "TimingTest",
+	}
+	if err := download(context.Background(), dc); err.error != nil {
+		t.Fatal(err)
+	}
+	// The slow writes to the store count as uploading, not transferring.
+	transfer, err := metrics.Gather("downloader_transfer_duration_seconds", prometheus.Labels{"dataset": "TimingTest"})
+	if err != nil || len(transfer) != 1 || transfer[0].Value >= 0.05 {
+		t.Errorf("downloader_transfer_duration_seconds is %+v, %v, expected less than the writes took", transfer, err)
+	}
+	upload, err := metrics.Gather("downloader_upload_duration_seconds", prometheus.Labels{"dataset": "TimingTest"})
+	if err != nil || len(upload) != 1 || upload[0].Value < 0.05 {
+		t.Errorf("downloader_upload_duration_seconds is %+v, %v, expected at least as long as the writes took", upload, err)
+	}
+}
+
+func TestDownloadCanceledMidBody(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Send part of the body, and then never finish it.
+		w.Write([]byte("Stuff"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	fs := &testStore{map[string]*testFileObject{}}
+	dc := config{
+		URL:           ts.URL + "/download",
+		Store:         fs,
+		PathPrefix:    "pre/",
+		FixedFilename: "file.tar.gz",
+		DedupRegexp:   regexp.MustCompile(`(pre/)`),
+		MaxDuration:   time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan errWithPermanence)
+	go func() { done <- download(ctx, dc) }()
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		if err.error == nil {
+			t.Error("download() succeeded after it was canceled")
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("download() did not return when it was canceled mid-body")
+	}
+	if len(fs.files) != 0 {
+		t.Errorf("download() stored %v after it was canceled", fs.files)
+	}
+}
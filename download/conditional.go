@@ -0,0 +1,61 @@
+package download
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/m-lab/downloader/file"
+)
+
+// httpValidators are the response headers of the last successful fetch
+// of a URL that let the next fetch be a conditional GET.
+type httpValidators struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// httpValidatorsName returns the name of the state object holding the
+// validators for url.
+func httpValidatorsName(url string) string {
+	return urlStateName("validators", url)
+}
+
+// loadHTTPValidators returns the validators saved for url, or nil if
+// there are none.
+func loadHTTPValidators(ctx context.Context, store file.Store, url string) (*httpValidators, error) {
+	v := &httpValidators{}
+	err := file.ReadJSON(ctx, store, httpValidatorsName(url), v)
+	if err == file.ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// setConditionalHeaders makes req conditional on the resource having
+// changed since v was saved.
+func (v *httpValidators) setConditionalHeaders(req *http.Request) {
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+// saveHTTPValidators remembers the validators of resp, if it has any,
+// for the next fetch of url.
+func saveHTTPValidators(ctx context.Context, store file.Store, url string, resp *http.Response) error {
+	v := &httpValidators{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if v.ETag == "" && v.LastModified == "" {
+		return nil
+	}
+	return file.WriteJSON(ctx, store, httpValidatorsName(url), v)
+}
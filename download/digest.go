@@ -0,0 +1,116 @@
+package download
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+
+	"github.com/m-lab/downloader/file"
+)
+
+// digestIndex records the MD5 of every object kept in one dedup
+// directory. It lets download decide whether a file is a duplicate
+// before the file is committed to the store, and without listing the
+// directory every time.
+type digestIndex struct {
+	Objects map[string]string `json:"objects"` // object name -> hex MD5
+}
+
+var (
+	digestIndexLocksMu sync.Mutex
+	digestIndexLocks   = map[string]*sync.Mutex{}
+)
+
+// lockDigestIndex serializes the updates of the index for searchDir, so
+// that two downloads adding to it at once don't lose one of the files.
+// The store has no conditional writes, so this only covers a single
+// process, and a store must not be shared by several downloaders. It
+// returns the function that unlocks the index again.
+func lockDigestIndex(searchDir string) func() {
+	digestIndexLocksMu.Lock()
+	mu, ok := digestIndexLocks[searchDir]
+	if !ok {
+		mu = &sync.Mutex{}
+		digestIndexLocks[searchDir] = mu
+	}
+	digestIndexLocksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// digestIndexName returns the name of the index object for searchDir.
+func digestIndexName(searchDir string) string {
+	return statePrefix + "digests/" + searchDir + ".index.json"
+}
+
+// loadDigestIndex reads the index for searchDir. If there is no index
+// yet, it is built from a listing of searchDir and saved, so that
+// directories written before the index existed are still deduped.
+func loadDigestIndex(ctx context.Context, store file.Store, searchDir string) (*digestIndex, error) {
+	defer lockDigestIndex(searchDir)()
+	return loadDigestIndexLocked(ctx, store, searchDir)
+}
+
+// loadDigestIndexLocked is loadDigestIndex for a caller already holding
+// the lock of searchDir.
+func loadDigestIndexLocked(ctx context.Context, store file.Store, searchDir string) (*digestIndex, error) {
+	index, built, err := readDigestIndex(ctx, store, searchDir)
+	if err != nil || !built {
+		return index, err
+	}
+	return index, file.WriteJSON(ctx, store, digestIndexName(searchDir), index)
+}
+
+// readDigestIndex is loadDigestIndex without saving the index it built,
+// which it reports with built.
+func readDigestIndex(ctx context.Context, store file.Store, searchDir string) (index *digestIndex, built bool, err error) {
+	index = &digestIndex{}
+	err = file.ReadJSON(ctx, store, digestIndexName(searchDir), index)
+	if err == nil {
+		if index.Objects == nil {
+			index.Objects = map[string]string{}
+		}
+		return index, false, nil
+	}
+	if err != file.ErrNotExist {
+		return nil, false, err
+	}
+	index.Objects = map[string]string{}
+	objects := store.List(ctx, searchDir)
+	for {
+		attrs, err := objects.Next()
+		if err == file.Done {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if len(attrs.MD5) != 0 {
+			index.Objects[attrs.Name] = hex.EncodeToString(attrs.MD5)
+		}
+	}
+	return index, true, nil
+}
+
+// md5s returns the index as a map of object names to MD5s.
+func (index *digestIndex) md5s() map[string][]byte {
+	md5Map := make(map[string][]byte, len(index.Objects))
+	for name, sum := range index.Objects {
+		if b, err := hex.DecodeString(sum); err == nil {
+			md5Map[name] = b
+		}
+	}
+	return md5Map
+}
+
+// addToDigestIndex records that fileName, with the given MD5, has been
+// committed to searchDir.
+func addToDigestIndex(ctx context.Context, store file.Store, searchDir string, fileName string, md5Hash []byte) error {
+	defer lockDigestIndex(searchDir)()
+	index, err := loadDigestIndexLocked(ctx, store, searchDir)
+	if err != nil {
+		return err
+	}
+	index.Objects[fileName] = hex.EncodeToString(md5Hash)
+	return file.WriteJSON(ctx, store, digestIndexName(searchDir), index)
+}
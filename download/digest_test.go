@@ -0,0 +1,61 @@
+package download
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/downloader/file"
+)
+
+// slowStore is a testStore whose reads take a while, so that concurrent
+// read-modify-write cycles overlap.
+type slowStore struct {
+	*testStore
+}
+
+func (fsto slowStore) GetFile(name string) file.Object {
+	return slowObject{fsto.testStore.GetFile(name).(*testFileObject)}
+}
+
+type slowObject struct {
+	*testFileObject
+}
+
+func (o slowObject) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	time.Sleep(time.Millisecond)
+	return o.testFileObject.GetReader(ctx)
+}
+
+func TestDigestIndexConcurrentAdds(t *testing.T) {
+	ctx := context.Background()
+	fs := slowStore{&testStore{map[string]*testFileObject{}}}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("pre/file%d", i)
+			sum := md5.Sum([]byte(name))
+			if err := addToDigestIndex(ctx, fs, "pre/", name, sum[:]); err != nil {
+				t.Errorf("addToDigestIndex(%s) returned %v", name, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	index, err := loadDigestIndex(ctx, fs, "pre/")
+	if err != nil || len(index.Objects) != 20 {
+		t.Errorf("The index is %+v, %v, expected all 20 files", index, err)
+	}
+}
+
+func TestRouteviewsDedupDir(t *testing.T) {
+	filename := "RouteViewIPv4/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz"
+	if dir := routeviewsFilenameToDedupeRegexp.FindStringSubmatch(filename)[1]; dir != "RouteViewIPv4/2017/06/" {
+		t.Errorf("Routeviews files are deduped in %q, expected their directory", dir)
+	}
+}
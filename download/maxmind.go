@@ -2,53 +2,230 @@ package download
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
+	conf "github.com/m-lab/downloader/config"
 	"github.com/m-lab/downloader/file"
-	"github.com/m-lab/downloader/metrics"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/m-lab/downloader/notify"
 )
 
 var maxmindFilenameToDedupRegexp = regexp.MustCompile(`(.*/).*/.*`)
 
-var maxmindDownloadInfo = []struct {
-	url      string
-	filename string
-	current  string
-}{
-	{
-		url:      "https://download.maxmind.com/geoip/databases/GeoLite2-City/download?suffix=tar.gz",
-		filename: "GeoLite2-City.tar.gz",
-		current:  "Maxmind/current/GeoLite2-City.tar.gz",
-	},
-}
-
-// MaxmindFiles takes a slice of urls pointing to maxmind files, a timestamp
-// that the user wants attached to the files, and the instance of the FileStore
-// interface where the user wants the files stored. It then downloads the files,
-// stores them, and returns and error on failure or nil on success. Guaranteed
-// to not introduce duplicates.
+// maxmindSource downloads a dataset of kind maxmind: a single permalink
+// that is saved under a directory named for the day it was fetched.
+type maxmindSource struct {
+	ds          conf.Dataset
+	timestamp   string // Overrides the date directory the files are placed in.
+	credentials func() (string, string, error)
+	notifier    notify.Notifier
+	validators  []Validator
+	counter     Counter
+}
+
+func newMaxmindSource(ds conf.Dataset, n notify.Notifier) (*maxmindSource, error) {
+	if ds.DedupRegexp == nil {
+		ds.DedupRegexp = &conf.Regexp{Regexp: maxmindFilenameToDedupRegexp}
+	}
+	if ds.Validators == nil && strings.HasSuffix(ds.Filename, ".tar.gz") {
+		// Every tarball MaxMind publishes holds an .mmdb database.
+		ds.Validators = []string{"gzip", "mmdb"}
+	}
+	validators, err := lookupValidators(ds.Validators)
+	if err != nil {
+		return nil, fmt.Errorf("dataset %s: %v", ds.Name, err)
+	}
+	var counter Counter
+	if strings.HasSuffix(ds.Filename, ".tar.gz") {
+		counter = countMMDB
+	}
+	return &maxmindSource{
+		ds:          ds,
+		credentials: func() (string, string, error) { return resolveAuth(ds.Auth) },
+		notifier:    n,
+		validators:  validators,
+		counter:     counter,
+	}, nil
+}
+
+func (m *maxmindSource) Name() string        { return m.ds.Name }
+func (m *maxmindSource) MetricLabel() string { return m.ds.MetricLabel }
+func (m *maxmindSource) currentName() string { return m.ds.CurrentName }
+
+func (m *maxmindSource) Discover(ctx context.Context, store file.Store) ([]Candidate, error) {
+	return []Candidate{{URL: m.ds.URL}}, nil
+}
+
+// DiscoverRange returns the release of every day from from up to, but not
+// including, to, as given by the date parameter of the permalink. Days
+// without a release are skipped when they are fetched.
+func (m *maxmindSource) DiscoverRange(ctx context.Context, store file.Store, from time.Time, to time.Time) ([]Candidate, error) {
+	var candidates []Candidate
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if day.Before(from) {
+			continue
+		}
+		u, err := maxmindDatedURL(m.ds.URL, day)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, Candidate{URL: u, Published: day, Backfill: true})
+	}
+	return candidates, nil
+}
+
+// maxmindDatedURL returns the permalink rawURL, asking for the release of
+// the given day instead of the latest one.
+func maxmindDatedURL(rawURL string, day time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("date", day.Format("20060102"))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Fetch downloads the latest release, or for a backfill, the release of
+// the day the candidate was published, into the directory of that day.
+// Backfilled releases leave current alone.
+func (m *maxmindSource) Fetch(ctx context.Context, store file.Store, c Candidate) error {
+	dc, err := m.downloadConfig(store, c)
+	if err != nil {
+		return err
+	}
+	return runFunctionWithRetry(ctx, download, dc, *waitAfterFirstDownloadFailure, *maximumWaitBetweenDownloadAttempts)
+}
+
+// Plan reports what Fetch would do with c, without writing to the store.
+func (m *maxmindSource) Plan(ctx context.Context, store file.Store, c Candidate) (PlannedFile, error) {
+	dc, err := m.downloadConfig(store, c)
+	if err != nil {
+		return PlannedFile{Dataset: m.ds.Name, URL: c.URL}, err
+	}
+	return plan(ctx, dc)
+}
+
+// downloadConfig returns the config that downloads c into store.
+func (m *maxmindSource) downloadConfig(store file.Store, c Candidate) (config, error) {
+	fileURL, checksumURL := m.ds.URL, m.ds.ChecksumURL
+	if c.Backfill {
+		var err error
+		if fileURL, err = maxmindDatedURL(m.ds.URL, c.Published); err != nil {
+			return config{}, err
+		}
+		if checksumURL != "" {
+			if checksumURL, err = maxmindDatedURL(m.ds.ChecksumURL, c.Published); err != nil {
+				return config{}, err
+			}
+		}
+	}
+	if c.URL != fileURL {
+		return config{}, errors.New("unknown MaxMind URL " + c.URL)
+	}
+	user, pass, err := m.credentials()
+	if err != nil {
+		return config{}, err
+	}
+	timestamp := m.timestamp
+	if timestamp == "" {
+		timestamp = time.Now().Format("2006/01/02/")
+	}
+	filePrefix := time.Now().UTC().Format("20060102T150405Z-")
+	currentName := m.ds.CurrentName
+	if c.Backfill {
+		timestamp = c.Published.Format("2006/01/02/")
+		filePrefix = c.Published.Format("20060102T150405Z-")
+		currentName = ""
+	}
+	dc := config{
+		URL:             fileURL,
+		Store:           store,
+		PathPrefix:      m.ds.PathPrefix + timestamp,
+		CurrentName:     currentName,
+		FilePrefix:      filePrefix,
+		FixedFilename:   m.ds.Filename,
+		DedupRegexp:     m.ds.DedupRegexp.Regexp,
+		MaxDuration:     *downloadTimeout,
+		BasicAuthUser:   user,
+		BasicAuthPass:   pass,
+		Conditional:     !c.Backfill,
+		ChecksumURL:     checksumURL,
+		Validators:      m.validators,
+		Counter:         m.counter,
+		MaxDeltaPercent: m.ds.MaxDeltaPercent,
+		Force:           m.ds.Force,
+		Dataset:         m.ds.Name,
+		Notifier:        m.notifier,
+		Backfill:        c.Backfill,
+		MissingOK:       c.Backfill,
+
+		LastModifiedIsPublished: true,
+	}
+	return dc, nil
+}
+
+// MaxmindFiles takes a timestamp that the user wants attached to the
+// files, the instance of the FileStore interface where the user wants
+// the files stored, and MaxMind credentials. It then downloads the
+// maxmind datasets of the default config, stores them, and returns an
+// error on failure or nil on success. Guaranteed to not introduce
+// duplicates.
 func MaxmindFiles(ctx context.Context, timestamp string, store file.Store, maxmindLicenseKey string, maxmindAccountID string) error {
+	sources, err := defaultMaxmindSources(timestamp, maxmindLicenseKey, maxmindAccountID)
+	if err != nil {
+		return err
+	}
 	var lastErr error
-	for _, info := range maxmindDownloadInfo {
-		dc := config{
-			URL:           info.url,
-			Store:         store,
-			PathPrefix:    "Maxmind/" + timestamp,
-			CurrentName:   info.current,
-			FilePrefix:    time.Now().UTC().Format("20060102T150405Z-"),
-			FixedFilename: info.filename,
-			DedupRegexp:   maxmindFilenameToDedupRegexp,
-			MaxDuration:   *downloadTimeout,
-			BasicAuthUser: maxmindAccountID,
-			BasicAuthPass: maxmindLicenseKey,
-		}
-		if err := runFunctionWithRetry(ctx, download, dc, *waitAfterFirstDownloadFailure, *maximumWaitBetweenDownloadAttempts); err != nil {
+	for _, src := range sources {
+		if err := Run(ctx, src, store); err != nil {
 			lastErr = err
-			metrics.FailedDownloadCount.With(prometheus.Labels{"download_type": "Maxmind"}).Inc()
 		}
 	}
 	return lastErr
+}
+
+// PlanMaxmindFiles reports what MaxmindFiles would do, without writing
+// anything to the store.
+func PlanMaxmindFiles(ctx context.Context, timestamp string, store file.Store, maxmindLicenseKey string, maxmindAccountID string) ([]PlannedFile, error) {
+	sources, err := defaultMaxmindSources(timestamp, maxmindLicenseKey, maxmindAccountID)
+	if err != nil {
+		return nil, err
+	}
+	var planned []PlannedFile
+	var lastErr error
+	for _, src := range sources {
+		p, err := Plan(ctx, src, store)
+		planned = append(planned, p...)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return planned, lastErr
+}
 
+// defaultMaxmindSources returns the sources of the maxmind datasets of the
+// default config, placing files in the timestamp directory and using the
+// given credentials.
+func defaultMaxmindSources(timestamp string, maxmindLicenseKey string, maxmindAccountID string) ([]*maxmindSource, error) {
+	var sources []*maxmindSource
+	for _, ds := range conf.Default().Datasets {
+		if ds.Kind != conf.KindMaxmind {
+			continue
+		}
+		src, err := newMaxmindSource(ds, nil)
+		if err != nil {
+			return nil, err
+		}
+		src.timestamp = timestamp
+		src.credentials = func() (string, string, error) { return maxmindAccountID, maxmindLicenseKey, nil }
+		sources = append(sources, src)
+	}
+	return sources, nil
 }
@@ -0,0 +1,100 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/m-lab/downloader/file"
+)
+
+// The outcomes of a PlannedFile.
+const (
+	PlannedNew         = "new"          // The file would be kept.
+	PlannedDuplicate   = "duplicate"    // The file would be dropped as a duplicate.
+	PlannedNotModified = "not modified" // The URL didn't change since the last fetch.
+	PlannedMissing     = "missing"      // There is no file to fetch.
+	PlannedFailed      = "failed"       // The file couldn't be fetched.
+)
+
+// PlannedFile is what a dry run found would happen to a file. New files
+// are not validated or compared with the last version, since that needs
+// them to be in the store.
+type PlannedFile struct {
+	Dataset string `json:"dataset"`
+	URL     string `json:"url"`
+	Outcome string `json:"outcome"`
+	Object  string `json:"object,omitempty"` // The name the file would be kept as.
+	// The name a new file would be copied to, if its dataset has a current
+	// name and the file would be the last one of the run to be promoted.
+	CurrentName string `json:"current_name,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Planner is a Source that can report what fetching a file would do,
+// without doing it.
+type Planner interface {
+	Source
+	// Plan downloads c like Fetch, but writes nothing to the store.
+	Plan(ctx context.Context, store file.Store, c Candidate) (PlannedFile, error)
+}
+
+// Plan discovers the files of src, like Run, and reports what fetching
+// each of them would do, without writing anything to the store. A file
+// that fails is reported as failed and does not stop the others from
+// being planned. It returns the last error encountered, or nil on
+// success.
+//
+// Deciding whether a file is new takes its MD5, so every file is
+// downloaded in full, and a dry run costs as much bandwidth as a real run.
+// Only URLs fetched with conditional requests that haven't changed since
+// the last real run are skipped.
+func Plan(ctx context.Context, src Source, store file.Store) ([]PlannedFile, error) {
+	p, ok := src.(Planner)
+	if !ok {
+		return nil, errors.New("source " + src.Name() + " does not support dry runs")
+	}
+	candidates, err := src.Discover(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	var planned []PlannedFile
+	var lastErr error
+	for _, c := range candidates {
+		pf, err := p.Plan(ctx, store, c)
+		if err != nil {
+			pf.Outcome = PlannedFailed
+			pf.Error = err.Error()
+			lastErr = err
+		}
+		planned = append(planned, pf)
+	}
+	// Each new file replaces the one before it in current, so only the
+	// last of them would be left there.
+	promoted := -1
+	for i := range planned {
+		if planned[i].Outcome == PlannedNew && planned[i].CurrentName != "" {
+			if promoted >= 0 {
+				planned[promoted].CurrentName = ""
+			}
+			promoted = i
+		}
+	}
+	return planned, lastErr
+}
+
+// plan runs download once as a dry run of dc and returns what it found.
+func plan(ctx context.Context, dc config) (PlannedFile, error) {
+	pf := &PlannedFile{Dataset: dc.Dataset, URL: dc.URL}
+	dc.DryRun = pf
+	err := download(ctx, dc)
+	return *pf, err.error
+}
+
+// discardWriter is the file.Writer of a dry run, which throws everything
+// away.
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return io.Discard.Write(p) }
+func (discardWriter) Close() error                { return nil }
+func (discardWriter) Abort() error                { return nil }
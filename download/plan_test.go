@@ -0,0 +1,135 @@
+package download
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	conf "github.com/m-lab/downloader/config"
+)
+
+func TestPlanMaxmind(t *testing.T) {
+	ctx := context.Background()
+	release := "Release 1"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, release)
+	}))
+	defer ts.Close()
+	src, err := newMaxmindSource(conf.Dataset{
+		Name:        "maxmind",
+		URL:         ts.URL + "/GeoLite2-City",
+		PathPrefix:  "Maxmind/",
+		Filename:    "GeoLite2-City.tar.gz",
+		CurrentName: "Maxmind/current/GeoLite2-City.tar.gz",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.timestamp = "2024/01/02/"
+	sum := md5.Sum([]byte("Release 1"))
+	fs := &testStore{map[string]*testFileObject{}}
+	fs.files["Maxmind/2024/01/01/20240101T000000Z-GeoLite2-City.tar.gz"] = &testFileObject{
+		name: "Maxmind/2024/01/01/20240101T000000Z-GeoLite2-City.tar.gz",
+		md5:  sum[:],
+		fsto: fs,
+	}
+	object := regexp.MustCompile(`^Maxmind/2024/01/02/\d{8}T\d{6}Z-GeoLite2-City.tar.gz$`)
+
+	planned, err := Plan(ctx, src, fs)
+	if err != nil || len(planned) != 1 {
+		t.Fatalf("Plan() = %+v, %v", planned, err)
+	}
+	if p := planned[0]; p.Outcome != PlannedDuplicate || !object.MatchString(p.Object) || p.CurrentName != "" || p.Dataset != "maxmind" {
+		t.Errorf("Plan() of a duplicate = %+v", p)
+	}
+
+	release = "Release 2"
+	planned, err = Plan(ctx, src, fs)
+	if err != nil || len(planned) != 1 {
+		t.Fatalf("Plan() = %+v, %v", planned, err)
+	}
+	if p := planned[0]; p.Outcome != PlannedNew || !object.MatchString(p.Object) || p.CurrentName != "Maxmind/current/GeoLite2-City.tar.gz" {
+		t.Errorf("Plan() of a new file = %+v", p)
+	}
+
+	// Not even the digest index that was built is saved.
+	if len(fs.files) != 1 {
+		t.Errorf("Plan() wrote to the store: %v", fs.files)
+	}
+}
+
+func TestPlanCaidaRouteviewsFiles(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pfx2as-creation.log":
+			fmt.Fprint(w, `3363	1497717708	2017/06/routeviews-rv2-20170616-1200.pfx2as.gz
+3364	1497803191	2017/06/routeviews-rv2-20170617-1200.pfx2as.gz`)
+		case "/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz":
+			w.Write(gzipped("1.0.0.0\t24\t13335\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+
+	planned, err := PlanCaidaRouteviewsFiles(context.Background(), ts.URL+"/pfx2as-creation.log", "RouteViewIPv4/", "RouteViewIPv4/current/routeview.pfx2as.gz", fs)
+	if err == nil || len(planned) != 2 {
+		t.Fatalf("PlanCaidaRouteviewsFiles() = %+v, %v", planned, err)
+	}
+	want := PlannedFile{
+		Dataset:     "RouteViewIPv4/",
+		URL:         ts.URL + "/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz",
+		Outcome:     PlannedNew,
+		Object:      "RouteViewIPv4/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz",
+		CurrentName: "RouteViewIPv4/current/routeview.pfx2as.gz",
+	}
+	if planned[0] != want {
+		t.Errorf("PlanCaidaRouteviewsFiles()[0] = %+v, expected %+v", planned[0], want)
+	}
+	if p := planned[1]; p.Outcome != PlannedFailed || p.Error == "" {
+		t.Errorf("PlanCaidaRouteviewsFiles()[1] = %+v, expected a failure", p)
+	}
+	if len(fs.files) != 0 {
+		t.Errorf("PlanCaidaRouteviewsFiles() wrote to the store: %v", fs.files)
+	}
+}
+
+func TestPlanPromotesOnlyTheLastNewFile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pfx2as-creation.log" {
+			fmt.Fprint(w, `3363	1497717708	2017/06/routeviews-rv2-20170616-1200.pfx2as.gz
+3364	1497803191	2017/06/routeviews-rv2-20170617-1200.pfx2as.gz`)
+			return
+		}
+		w.Write(gzipped("1.0.0.0\t24\t13335\n" + r.URL.Path))
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+
+	planned, err := PlanCaidaRouteviewsFiles(context.Background(), ts.URL+"/pfx2as-creation.log", "RouteViewIPv4/", "RouteViewIPv4/current/routeview.pfx2as.gz", fs)
+	if err != nil || len(planned) != 2 {
+		t.Fatalf("PlanCaidaRouteviewsFiles() = %+v, %v", planned, err)
+	}
+	if planned[0].Outcome != PlannedNew || planned[0].CurrentName != "" {
+		t.Errorf("The first new file would be promoted: %+v", planned[0])
+	}
+	if planned[1].Outcome != PlannedNew || planned[1].CurrentName != "RouteViewIPv4/current/routeview.pfx2as.gz" {
+		t.Errorf("The last new file would not be promoted: %+v", planned[1])
+	}
+
+	// Without a current name, nothing is promoted.
+	planned, err = PlanCaidaRouteviewsFiles(context.Background(), ts.URL+"/pfx2as-creation.log", "RouteViewIPv4/", "", fs)
+	if err != nil || len(planned) != 2 {
+		t.Fatalf("PlanCaidaRouteviewsFiles() = %+v, %v", planned, err)
+	}
+	for _, p := range planned {
+		if p.CurrentName != "" {
+			t.Errorf("A file of a dataset without a current name would be promoted: %+v", p)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package download
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/downloader/file"
+)
+
+// quarantinePrefix is where files that failed validation are moved to,
+// instead of being copied to current.
+const quarantinePrefix = "quarantine/"
+
+// sidecarSuffix is appended to the name of a quarantined file to get the
+// name of the Quarantined sidecar describing it.
+const sidecarSuffix = ".quarantine.json"
+
+// Quarantined describes a file that was rejected and kept out of its
+// dataset for manual review. It is saved as JSON next to the file.
+type Quarantined struct {
+	Name    string        `json:"name"`    // The name of the quarantined file.
+	Dataset string        `json:"dataset"` // The dataset the file was rejected from.
+	Reason  string        `json:"reason"`  // Why the file was rejected.
+	Time    time.Time     `json:"time"`    // When the file was rejected.
+	URL     string        `json:"url"`     // The URL the file was downloaded from.
+	Headers http.Header   `json:"headers"` // The HTTP response headers of the download.
+	MD5     string        `json:"md5"`     // The MD5 of the file, in hex.
+	Stats   *VersionStats `json:"stats,omitempty"`
+	// Where the file goes when it is released.
+	ArchiveName string `json:"archive_name"`
+	CurrentName string `json:"current_name,omitempty"`
+	DedupDir    string `json:"dedup_dir"`
+	// For a file listed in a generation log, where the checkpoint goes
+	// when it is released.
+	LogURL     string `json:"log_url,omitempty"`
+	Seqnum     int    `json:"seqnum,omitempty"`
+	PrevSeqnum int    `json:"prev_seqnum,omitempty"`
+}
+
+// quarantinedError is the reason a file was quarantined by download.
+type quarantinedError struct {
+	error
+}
+
+// quarantineName returns where to quarantine filename, a file of
+// dataset, at time t.
+func quarantineName(dataset string, filename string, t time.Time) string {
+	dataset = strings.Trim(dataset, "/")
+	if dataset == "" {
+		dataset = "unknown"
+	}
+	return quarantinePrefix + dataset + "/" + t.UTC().Format("20060102T150405Z") + "/" + path.Base(filename)
+}
+
+// quarantine moves obj, a new file of dc.Dataset, out of the dataset and
+// into the quarantine area, with q as its sidecar. The caller fills in
+// why obj was rejected and where it would have been kept. If it fails,
+// whatever it already put in quarantine is removed again, so the file is
+// never in quarantine without its sidecar, nor both there and in the
+// dataset.
+func quarantine(ctx context.Context, dc config, obj file.Object, q *Quarantined) error {
+	q.Time = time.Now().UTC()
+	q.Name = quarantineName(dc.Dataset, q.ArchiveName, q.Time)
+	q.Dataset = dc.Dataset
+	q.URL = dc.URL
+	q.CurrentName = dc.CurrentName
+	q.LogURL = dc.LogURL
+	q.Seqnum = dc.Seqnum
+	q.PrevSeqnum = dc.PrevSeqnum
+	if err := obj.CopyTo(ctx, q.Name); err != nil {
+		return err
+	}
+	copied := dc.Store.GetFile(q.Name)
+	if err := file.WriteJSON(ctx, dc.Store, q.Name+sidecarSuffix, q); err != nil {
+		copied.DeleteFile(ctx)
+		return err
+	}
+	if err := obj.DeleteFile(ctx); err != nil {
+		dc.Store.GetFile(q.Name + sidecarSuffix).DeleteFile(ctx)
+		copied.DeleteFile(ctx)
+		return err
+	}
+	return nil
+}
+
+// ListQuarantined returns the files in quarantine, oldest first. If
+// dataset is not empty, only the files of that dataset are returned.
+func ListQuarantined(ctx context.Context, store file.Store, dataset string) ([]*Quarantined, error) {
+	prefix := quarantinePrefix
+	if dataset != "" {
+		prefix += strings.Trim(dataset, "/") + "/"
+	}
+	var names []string
+	objects := store.List(ctx, prefix)
+	for {
+		attrs, err := objects.Next()
+		if err == file.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(attrs.Name, sidecarSuffix) {
+			names = append(names, attrs.Name)
+		}
+	}
+	var items []*Quarantined
+	for _, name := range names {
+		q := &Quarantined{}
+		if err := file.ReadJSON(ctx, store, name, q); err != nil {
+			return nil, err
+		}
+		items = append(items, q)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Time.Before(items[j].Time) })
+	return items, nil
+}
+
+// findQuarantined returns the name of the quarantined file of dataset
+// whose MD5 is md5Hash, or "" if there is none.
+func findQuarantined(ctx context.Context, store file.Store, dataset string, md5Hash []byte) (string, error) {
+	items, err := ListQuarantined(ctx, store, dataset)
+	if err != nil {
+		return "", err
+	}
+	for _, q := range items {
+		if q.MD5 == hex.EncodeToString(md5Hash) {
+			return q.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// ReleaseQuarantined puts the quarantined file name back where it would
+// have been kept had it not been rejected: into its dataset's archive
+// and its digest index. Unless a version of the dataset was kept since
+// the file was rejected, it is also promoted: copied to its current name,
+// and made the version the next one is compared with. It returns whether
+// the file was promoted. Either way, the checkpoint of its generation log
+// moves past it if it was stuck on it. Use it once a person has decided
+// the file is fine after all, e.g. to force a version that changed more
+// than allowed.
+func ReleaseQuarantined(ctx context.Context, store file.Store, name string) (*Quarantined, bool, error) {
+	q := &Quarantined{}
+	if err := file.ReadJSON(ctx, store, name+sidecarSuffix, q); err != nil {
+		if err == file.ErrNotExist {
+			return nil, false, errors.New(name + " is not in quarantine")
+		}
+		return nil, false, err
+	}
+	md5Hash, err := hex.DecodeString(q.MD5)
+	if err != nil {
+		return nil, false, err
+	}
+	promote := true
+	if q.Dataset != "" {
+		history, err := loadVersionHistory(ctx, store, q.Dataset)
+		if err != nil {
+			return nil, false, err
+		}
+		// Releasing an old file mustn't replace a newer one in current.
+		if latest := history.latest(); latest != nil && latest.Time.After(q.Time) {
+			promote = false
+		}
+	}
+	obj := store.GetFile(name)
+	if err := obj.CopyTo(ctx, q.ArchiveName); err != nil {
+		return nil, false, err
+	}
+	if promote && q.CurrentName != "" {
+		if err := store.GetFile(q.ArchiveName).CopyTo(ctx, q.CurrentName); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := addToDigestIndex(ctx, store, q.DedupDir, q.ArchiveName, md5Hash); err != nil {
+		return nil, false, err
+	}
+	if promote && q.Stats != nil && q.Dataset != "" {
+		stats := *q.Stats
+		stats.Object = q.ArchiveName
+		if err := addToVersionHistory(ctx, store, q.Dataset, stats); err != nil {
+			return nil, false, err
+		}
+	}
+	if q.LogURL != "" {
+		seqnum, err := advanceCheckpoint(ctx, store, q.LogURL, q.PrevSeqnum, q.Seqnum)
+		if err != nil {
+			return nil, false, err
+		}
+		trackCheckpoint(q.Dataset, seqnum)
+	}
+	if err := obj.DeleteFile(ctx); err != nil {
+		return nil, false, err
+	}
+	return q, promote, store.GetFile(name + sidecarSuffix).DeleteFile(ctx)
+}
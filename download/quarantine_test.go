@@ -0,0 +1,237 @@
+package download
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/downloader/file"
+)
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	fs := &testStore{map[string]*testFileObject{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html>Error</html>")
+	}))
+	defer ts.Close()
+	dc := config{
+		URL:         ts.URL + "/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz",
+		Store:       fs,
+		PathPrefix:  "RouteViewIPv4/",
+		CurrentName: "RouteViewIPv4/current/routeview.pfx2as.gz",
+		URLRegexp:   routeviewsURLToFilenameRegexp,
+		DedupRegexp: routeviewsFilenameToDedupeRegexp,
+		MaxDuration: time.Minute,
+		Validators:  []Validator{validateGzip, validatePfx2as},
+		Dataset:     "routeviews-v4",
+	}
+	err := download(ctx, dc)
+	if err.error == nil || !err.permanent {
+		t.Errorf("download() returned %+v, expected a permanent error", err)
+	}
+
+	// Only the quarantined file and its sidecar are kept.
+	quarantined := regexp.MustCompile(`^quarantine/routeviews-v4/\d{8}T\d{6}Z/routeviews-rv2-20170616-1200.pfx2as.gz(\.quarantine\.json)?$`)
+	for name := range fs.files {
+		if !quarantined.MatchString(name) && !strings.HasPrefix(name, statePrefix) {
+			t.Errorf("Found %s in the store, expected only the quarantined file", name)
+		}
+	}
+	items, lerr := ListQuarantined(ctx, fs, "routeviews-v4")
+	if lerr != nil || len(items) != 1 {
+		t.Fatalf("ListQuarantined() = %v, %v", items, lerr)
+	}
+	q := items[0]
+	if q.URL != dc.URL || q.Headers.Get("Content-Type") != "text/html" || !strings.Contains(q.Reason, "gzip") ||
+		q.ArchiveName != "RouteViewIPv4/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz" {
+		t.Errorf("The sidecar is %+v", q)
+	}
+	if items, _ := ListQuarantined(ctx, fs, "maxmind"); len(items) != 0 {
+		t.Errorf("ListQuarantined(maxmind) = %v", items)
+	}
+
+	// Releasing it puts it where it would have been kept.
+	if _, _, rerr := ReleaseQuarantined(ctx, fs, q.Name); rerr != nil {
+		t.Fatalf("ReleaseQuarantined() returned %v", rerr)
+	}
+	for _, name := range []string{q.ArchiveName, q.CurrentName} {
+		if _, ok := fs.files[name]; !ok {
+			t.Errorf("%s was not released", name)
+		}
+	}
+	if items, _ := ListQuarantined(ctx, fs, ""); len(items) != 0 {
+		t.Errorf("ListQuarantined() after release = %v", items)
+	}
+	if isNew, _ := IsFileNew(ctx, fs, "RouteViewIPv4/other", fs.files[q.ArchiveName].md5, q.DedupDir); isNew {
+		t.Error("The released file was not added to the digest index")
+	}
+	if _, _, rerr := ReleaseQuarantined(ctx, fs, q.Name); rerr == nil {
+		t.Error("Releasing twice should fail")
+	}
+}
+
+func TestQuarantineSkipsQuarantined(t *testing.T) {
+	ctx := context.Background()
+	fs := &testStore{map[string]*testFileObject{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>Error</html>")
+	}))
+	defer ts.Close()
+	dc := config{
+		URL:           ts.URL + "/GeoLite2-City.tar.gz",
+		Store:         fs,
+		PathPrefix:    "Maxmind/",
+		FilePrefix:    "2024/05/07/20240507T000000Z-",
+		FixedFilename: "GeoLite2-City.tar.gz",
+		DedupRegexp:   maxmindFilenameToDedupRegexp,
+		MaxDuration:   time.Minute,
+		Validators:    []Validator{validateGzip},
+		Dataset:       "maxmind",
+	}
+	if err := download(ctx, dc); err.error == nil {
+		t.Fatal("download() kept an invalid file")
+	}
+	// The same file is not quarantined again on the next run.
+	if err := download(ctx, dc); err.error != nil {
+		t.Errorf("download() of a file already in quarantine returned %v", err)
+	}
+	if items, err := ListQuarantined(ctx, fs, "maxmind"); err != nil || len(items) != 1 {
+		t.Errorf("ListQuarantined() = %v, %v, expected a single file", items, err)
+	}
+	for name := range fs.files {
+		if strings.HasPrefix(name, "Maxmind/") {
+			t.Errorf("Found %s in the store, expected the file only in quarantine", name)
+		}
+	}
+}
+
+func TestQuarantineFailure(t *testing.T) {
+	ctx := context.Background()
+	fs := &testStore{map[string]*testFileObject{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>Error</html>")
+	}))
+	defer ts.Close()
+	dc := config{
+		URL:         ts.URL + "/file.quarantineFail",
+		Store:       fs,
+		PathPrefix:  "pre",
+		CurrentName: "pre/current",
+		URLRegexp:   regexp.MustCompile(`.*()(/.*)`),
+		DedupRegexp: regexp.MustCompile(`(pre/)`),
+		MaxDuration: time.Minute,
+		Validators:  []Validator{validateGzip},
+		Dataset:     "test",
+	}
+
+	// A file that can't be quarantined is neither kept nor given up on.
+	err := download(ctx, dc)
+	if err.error == nil || err.permanent {
+		t.Errorf("download() returned %+v, expected a retryable error", err)
+	}
+	for name := range fs.files {
+		if !strings.HasPrefix(name, statePrefix) {
+			t.Errorf("Found %s in the store, expected the rejected file to be deleted", name)
+		}
+	}
+	errorMD5 := md5.Sum([]byte("<html>Error</html>"))
+	if isNew, _ := IsFileNew(ctx, fs, "pre/other", errorMD5[:], "pre/"); !isNew {
+		t.Error("The rejected file was added to the digest index")
+	}
+}
+
+// sidecarFailStore is a testStore that can't write quarantine sidecars.
+type sidecarFailStore struct {
+	*testStore
+}
+
+func (fsto sidecarFailStore) GetFile(name string) file.Object {
+	if strings.HasSuffix(name, sidecarSuffix) {
+		// testWriter fails to write to any name ending in copyFail.
+		return &testFileObject{name: name + "/copyFail", data: bytes.NewBuffer(nil), fsto: fsto.testStore}
+	}
+	return fsto.testStore.GetFile(name)
+}
+
+func TestQuarantineCleanup(t *testing.T) {
+	ctx := context.Background()
+	fs := &testStore{map[string]*testFileObject{
+		"pre/file": {name: "pre/file", data: bytes.NewBufferString("Stuff")},
+	}}
+	fs.files["pre/file"].fsto = fs
+	dc := config{URL: "http://example.com/file", Store: sidecarFailStore{fs}, Dataset: "test"}
+	q := &Quarantined{Reason: "test", ArchiveName: "pre/file", DedupDir: "pre/"}
+	if err := quarantine(ctx, dc, fs.files["pre/file"], q); err == nil {
+		t.Fatal("quarantine() succeeded without writing the sidecar")
+	}
+	if _, ok := fs.files["pre/file"]; !ok {
+		t.Error("The file was deleted although it wasn't quarantined")
+	}
+	for name := range fs.files {
+		if strings.HasPrefix(name, quarantinePrefix) {
+			t.Errorf("Found %s in quarantine without its sidecar", name)
+		}
+	}
+}
+
+func TestQuarantineCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	*maximumWaitBetweenDownloadAttempts = 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "logFile"):
+			fmt.Fprint(w, "3363\t1497717708\t2017/06/routeviews-rv2-20170616-1200.pfx2as.gz\n"+
+				"3364\t1497803191\t2017/06/routeviews-rv2-20170617-1200.pfx2as.gz\n"+
+				"3365\t1497889838\t2017/06/routeviews-rv2-20170618-1200.pfx2as.gz\n")
+		case strings.Contains(r.URL.Path, "20170617"):
+			fmt.Fprint(w, "<html>Error</html>")
+		default:
+			gz := gzip.NewWriter(w)
+			gz.Comment = r.URL.String()
+			fmt.Fprint(gz, "1.0.0.0\t24\t13335\n")
+			gz.Close()
+		}
+	}))
+	defer ts.Close()
+	logURL := ts.URL + "/logFile"
+
+	// The invalid file is quarantined and the checkpoint moves past it,
+	// so the next run doesn't download it again.
+	fs := &testStore{map[string]*testFileObject{}}
+	if err := CaidaRouteviewsFiles(ctx, logURL, "rv/", "", fs); err == nil {
+		t.Error("CaidaRouteviewsFiles() didn't report the quarantined file")
+	}
+	if seqnum, err := loadCheckpoint(ctx, fs, logURL); err != nil || seqnum != 3365 {
+		t.Errorf("The checkpoint is %d, %v, expected 3365", seqnum, err)
+	}
+	if err := CaidaRouteviewsFiles(ctx, logURL, "rv/", "", fs); err != nil {
+		t.Errorf("CaidaRouteviewsFiles() returned %v on the second run", err)
+	}
+	items, err := ListQuarantined(ctx, fs, "")
+	if err != nil || len(items) != 1 {
+		t.Fatalf("ListQuarantined() = %v, %v, expected a single file", items, err)
+	}
+	q := items[0]
+	if q.LogURL != logURL || q.Seqnum != 3364 || q.PrevSeqnum != 3363 {
+		t.Errorf("The sidecar is %+v", q)
+	}
+
+	// Releasing a file the checkpoint is stuck on moves it past the file.
+	saveCheckpoint(ctx, fs, logURL, 3363)
+	if _, _, err := ReleaseQuarantined(ctx, fs, q.Name); err != nil {
+		t.Fatalf("ReleaseQuarantined() returned %v", err)
+	}
+	if seqnum, err := loadCheckpoint(ctx, fs, logURL); err != nil || seqnum != 3364 {
+		t.Errorf("The checkpoint is %d, %v after release, expected 3364", seqnum, err)
+	}
+}
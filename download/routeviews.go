@@ -4,19 +4,23 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	conf "github.com/m-lab/downloader/config"
 	"github.com/m-lab/downloader/file"
 	"github.com/m-lab/downloader/metrics"
+	"github.com/m-lab/downloader/notify"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
 	routeviewsURLToFilenameRegexp    = regexp.MustCompile(`.*(\d{4}/\d{2}/)(.*)`)
-	routeviewsFilenameToDedupeRegexp = regexp.MustCompile(`(.*)`)
+	routeviewsFilenameToDedupeRegexp = regexp.MustCompile(`(.*/)`)
 )
 
 // urlAndSeqNum is a struct for bundling the Routeview URL and Seqnum
@@ -28,41 +32,206 @@ type urlAndSeqNum struct {
 	// routeview generation log file. An example of
 	// the generation log file can be found at:
 	// http://data.caida.org/datasets/routing/routeviews-prefix2as/pfx2as-creation.log
+	Timestamp time.Time // When the file was generated, as given in the log.
 }
 
-// CaidaRouteviewsFiles takes a url pointing to a routeview
-// generation log, a directory prefix that the user wants the files
-// placed in, a pointer to the SeqNum of the last successful download,
-// and the instance of the store interface where the user wants the
-// files stored. It will download the files listed in the log file and
-// is guaranteed not to introduce duplicates
-func CaidaRouteviewsFiles(ctx context.Context, logFileURL string, directory string, lastDownloaded *int, canonicalName string, store file.Store) error {
-	var lastErr error
-	routeViewsURLsAndIDs, err := genRouteViewURLs(logFileURL, *lastDownloaded)
+// routeviewsSource downloads a dataset of kind routeviews: the files
+// listed in a Routeviews generation log.
+type routeviewsSource struct {
+	ds         conf.Dataset
+	notifier   notify.Notifier
+	validators []Validator
+}
+
+func newRouteviewsSource(ds conf.Dataset, n notify.Notifier) (*routeviewsSource, error) {
+	if ds.URLRegexp == nil {
+		ds.URLRegexp = &conf.Regexp{Regexp: routeviewsURLToFilenameRegexp}
+	}
+	if ds.DedupRegexp == nil {
+		ds.DedupRegexp = &conf.Regexp{Regexp: routeviewsFilenameToDedupeRegexp}
+	}
+	if ds.Validators == nil {
+		ds.Validators = []string{"gzip", "pfx2as"}
+	}
+	validators, err := lookupValidators(ds.Validators)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("dataset %s: %v", ds.Name, err)
+	}
+	return &routeviewsSource{ds: ds, notifier: n, validators: validators}, nil
+}
+
+func (r *routeviewsSource) Name() string        { return r.ds.Name }
+func (r *routeviewsSource) MetricLabel() string { return r.ds.MetricLabel }
+func (r *routeviewsSource) currentName() string { return r.ds.CurrentName }
+
+// Discover returns the files listed in the log after the checkpointed
+// seqnum.
+func (r *routeviewsSource) Discover(ctx context.Context, store file.Store) ([]Candidate, error) {
+	lastDownloaded, err := loadCheckpoint(ctx, store, r.ds.Log)
+	if err != nil {
+		// Without the checkpoint we would download the whole log again.
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Checkpoint Load Error"}).Inc()
+		return nil, err
+	}
+	trackCheckpoint(r.Name(), lastDownloaded)
+	// The whole log is read, to find when the checkpointed file was
+	// published as well as the files after it.
+	routeViewsURLsAndIDs, err := genRouteViewURLs(ctx, r.ds.Log, 0)
+	if err != nil {
+		return nil, err
 	}
+	var candidates []Candidate
+	prev := lastDownloaded
 	for _, urlAndID := range routeViewsURLsAndIDs {
-		dc := config{
-			URL:         urlAndID.URL,
-			Store:       store,
-			PathPrefix:  directory,
-			FilePrefix:  "",
-			CurrentName: canonicalName,
-			URLRegexp:   routeviewsURLToFilenameRegexp,
-			DedupRegexp: routeviewsFilenameToDedupeRegexp,
-			MaxDuration: *downloadTimeout,
+		if urlAndID.Seqnum == lastDownloaded {
+			trackPublished(r.Name(), urlAndID.Timestamp)
 		}
-		if err := runFunctionWithRetry(ctx, download, dc, *waitAfterFirstDownloadFailure, *maximumWaitBetweenDownloadAttempts); err != nil {
-			lastErr = err
-			metrics.FailedDownloadCount.With(prometheus.Labels{"download_type": directory}).Inc()
+		if urlAndID.Seqnum <= lastDownloaded {
+			continue
 		}
-		if lastErr == nil {
-			*lastDownloaded = urlAndID.Seqnum
+		candidates = append(candidates, Candidate{URL: urlAndID.URL, Seqnum: urlAndID.Seqnum, PrevSeqnum: prev, Published: urlAndID.Timestamp})
+		prev = urlAndID.Seqnum
+	}
+	return candidates, nil
+}
+
+// DiscoverRange returns every file in the log that was generated from
+// from up to, but not including, to, whether it was downloaded before or
+// not.
+func (r *routeviewsSource) DiscoverRange(ctx context.Context, store file.Store, from time.Time, to time.Time) ([]Candidate, error) {
+	routeViewsURLsAndIDs, err := genRouteViewURLs(ctx, r.ds.Log, 0)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Candidate
+	for _, urlAndID := range routeViewsURLsAndIDs {
+		if urlAndID.Timestamp.Before(from) || !urlAndID.Timestamp.Before(to) {
+			continue
 		}
+		candidates = append(candidates, Candidate{
+			URL:       urlAndID.URL,
+			Seqnum:    urlAndID.Seqnum,
+			Published: urlAndID.Timestamp,
+			Backfill:  true,
+		})
+	}
+	return candidates, nil
+}
+
+// Fetch downloads one file and then moves the checkpoint forward to
+// it, but only if the checkpoint is still at the file before it. That
+// way the checkpoint never moves past a file that failed. A file that was
+// quarantined has been dealt with, so the checkpoint moves past it too,
+// rather than every run downloading and quarantining it again. Backfilled
+// files leave the checkpoint and current alone.
+func (r *routeviewsSource) Fetch(ctx context.Context, store file.Store, c Candidate) error {
+	dc, err := r.downloadConfig(store, c)
+	if err != nil {
+		return err
+	}
+	err = runFunctionWithRetry(ctx, download, dc, *waitAfterFirstDownloadFailure, *maximumWaitBetweenDownloadAttempts)
+	var quarantined quarantinedError
+	if err != nil && !errors.As(err, &quarantined) {
+		return err
+	}
+	if c.Backfill {
+		return err
+	}
+	seqnum, cerr := advanceCheckpoint(ctx, store, r.ds.Log, c.PrevSeqnum, c.Seqnum)
+	if cerr != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Checkpoint Save Error"}).Inc()
+		return cerr
+	}
+	trackCheckpoint(r.Name(), seqnum)
+	if seqnum == c.Seqnum && err == nil {
+		trackPublished(r.Name(), c.Published)
+	}
+	return err
+}
+
+// Plan reports what Fetch would do with c, without writing to the store
+// or moving the checkpoint.
+func (r *routeviewsSource) Plan(ctx context.Context, store file.Store, c Candidate) (PlannedFile, error) {
+	dc, err := r.downloadConfig(store, c)
+	if err != nil {
+		return PlannedFile{Dataset: r.ds.Name, URL: c.URL}, err
+	}
+	return plan(ctx, dc)
+}
+
+// downloadConfig returns the config that downloads c into store.
+func (r *routeviewsSource) downloadConfig(store file.Store, c Candidate) (config, error) {
+	user, pass, err := resolveAuth(r.ds.Auth)
+	if err != nil {
+		return config{}, err
+	}
+	currentName := r.ds.CurrentName
+	if c.Backfill {
+		currentName = ""
+	}
+	dc := config{
+		URL:             c.URL,
+		Store:           store,
+		PathPrefix:      r.ds.PathPrefix,
+		FilePrefix:      "",
+		CurrentName:     currentName,
+		URLRegexp:       r.ds.URLRegexp.Regexp,
+		DedupRegexp:     r.ds.DedupRegexp.Regexp,
+		MaxDuration:     *downloadTimeout,
+		BasicAuthUser:   user,
+		BasicAuthPass:   pass,
+		Dataset:         r.ds.Name,
+		Notifier:        r.notifier,
+		Validators:      r.validators,
+		Counter:         countPfx2as,
+		MaxDeltaPercent: r.ds.MaxDeltaPercent,
+		Force:           r.ds.Force,
+		Backfill:        c.Backfill,
+	}
+	if !c.Backfill {
+		dc.LogURL = r.ds.Log
+		dc.Seqnum = c.Seqnum
+		dc.PrevSeqnum = c.PrevSeqnum
 	}
-	return lastErr
+	return dc, nil
+}
+
+// CaidaRouteviewsFiles takes a url pointing to a routeview
+// generation log, a directory prefix that the user wants the files
+// placed in, and the instance of the store interface where the user
+// wants the files stored. It will download the files listed in the log
+// file and is guaranteed not to introduce duplicates. The seqnum of the
+// last file downloaded successfully is checkpointed in the store, so
+// each file is only downloaded once, even across restarts.
+func CaidaRouteviewsFiles(ctx context.Context, logFileURL string, directory string, canonicalName string, store file.Store) error {
+	src, err := caidaRouteviewsSource(logFileURL, directory, canonicalName)
+	if err != nil {
+		return err
+	}
+	return Run(ctx, src, store)
+}
 
+// PlanCaidaRouteviewsFiles reports what CaidaRouteviewsFiles would do,
+// without writing anything to the store.
+func PlanCaidaRouteviewsFiles(ctx context.Context, logFileURL string, directory string, canonicalName string, store file.Store) ([]PlannedFile, error) {
+	src, err := caidaRouteviewsSource(logFileURL, directory, canonicalName)
+	if err != nil {
+		return nil, err
+	}
+	return Plan(ctx, src, store)
+}
+
+// caidaRouteviewsSource returns the source of the files listed in the log
+// at logFileURL, placed in directory.
+func caidaRouteviewsSource(logFileURL string, directory string, canonicalName string) (*routeviewsSource, error) {
+	return newRouteviewsSource(conf.Dataset{
+		Name:        directory,
+		Kind:        conf.KindRouteviews,
+		MetricLabel: directory,
+		Log:         logFileURL,
+		PathPrefix:  directory,
+		CurrentName: canonicalName,
+	}, nil)
 }
 
 // genRouteViewURLs takes a URL pointing to a routeview log file, and
@@ -70,14 +239,18 @@ func CaidaRouteviewsFiles(ctx context.Context, logFileURL string, directory stri
 // download. It returns a slice of urlAndSeqNum structs which contain
 // the files that the user needs to download from the routeview
 // webserver.
-func genRouteViewURLs(logFileURL string, lastDownloaded int) ([]urlAndSeqNum, error) {
+func genRouteViewURLs(ctx context.Context, logFileURL string, lastDownloaded int) ([]urlAndSeqNum, error) {
 	var urlsAndIDs []urlAndSeqNum
 
 	// Compile parser regex
 	re := regexp.MustCompile(`(\d{1,6})\s*(\d{10})\s*(.*)`)
 
 	// Get the generation log file from the routeviews website
-	resp, err := http.Get(logFileURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, logFileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		metrics.RouteviewsURLErrorCount.
 			With(prometheus.Labels{"source": "Couldn't grab the log file from the Routeviews server."}).Inc()
@@ -105,8 +278,10 @@ func genRouteViewURLs(logFileURL string, lastDownloaded int) ([]urlAndSeqNum, er
 			continue
 		}
 		if seqNum > lastDownloaded {
+			// The regexp only matches ten digits, so this can't fail.
+			unixTime, _ := strconv.ParseInt(match[2], 10, 64)
 			urlsAndIDs = append(urlsAndIDs,
-				urlAndSeqNum{logFileURL[:strings.LastIndex(logFileURL, "/")+1] + match[3], seqNum})
+				urlAndSeqNum{logFileURL[:strings.LastIndex(logFileURL, "/")+1] + match[3], seqNum, time.Unix(unixTime, 0).UTC()})
 		}
 	}
 	return urlsAndIDs, nil
@@ -1,6 +1,7 @@
 package download
 
 import (
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/m-lab/downloader/file"
 )
@@ -46,6 +48,23 @@ func TestDownloadCaidaRouteviewsFiles(t *testing.T) {
 			fsto:    &testStore{map[string]*testFileObject{}},
 			res:     errors.New("3"),
 		},
+		{
+			// Resuming from a checkpoint only downloads the newer files.
+			logFile: "/logFile2",
+			dir:     "test4/",
+			lastD:   3363,
+			lastS:   3364,
+			fsto:    &testStore{map[string]*testFileObject{}},
+			res:     errors.New("4"),
+		},
+		{
+			logFile: "/logFile1",
+			dir:     "test5/",
+			lastD:   3365,
+			lastS:   3365,
+			fsto:    &testStore{map[string]*testFileObject{}},
+			res:     nil,
+		},
 	}
 	*maximumWaitBetweenDownloadAttempts = 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -88,15 +107,23 @@ func TestDownloadCaidaRouteviewsFiles(t *testing.T) {
 3365	1497889838	2017/06/copyFail`)
 			return
 		}
-		fmt.Fprint(w, r.URL.String())
+		// A valid pfx2as file, made unique by naming its URL.
+		gz := gzip.NewWriter(w)
+		gz.Comment = r.URL.String()
+		fmt.Fprint(gz, "1.0.0.0\t24\t13335\n")
+		gz.Close()
 	}))
 	for _, test := range tests {
-		res := CaidaRouteviewsFiles(context.Background(), ts.URL+test.logFile, test.dir, &test.lastD, "", test.fsto)
+		if test.lastD != 0 {
+			saveCheckpoint(context.Background(), test.fsto, ts.URL+test.logFile, test.lastD)
+		}
+		res := CaidaRouteviewsFiles(context.Background(), ts.URL+test.logFile, test.dir, "", test.fsto)
 		if (res == nil && test.res != nil) || (res != nil && test.res == nil) {
 			t.Errorf("Expected %t, got %t!!!", test.res, res)
 		}
-		if test.lastD != test.lastS {
-			t.Errorf("Expected %d, got %d", test.lastS, test.lastD)
+		lastD, err := loadCheckpoint(context.Background(), test.fsto, ts.URL+test.logFile)
+		if err != nil || lastD != test.lastS {
+			t.Errorf("Expected %d, got %d, %v", test.lastS, lastD, err)
 		}
 	}
 }
@@ -160,50 +187,50 @@ func TestGenRouteViewURLs(t *testing.T) {
 		res            []urlAndSeqNum
 	}{
 		{"", false, 0, []urlAndSeqNum{
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170616-1200.pfx2as.gz", 3363},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170617-1200.pfx2as.gz", 3364},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170618-1000.pfx2as.gz", 3365},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170619-1200.pfx2as.gz", 3366},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170620-1200.pfx2as.gz", 3367},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170621-1000.pfx2as.gz", 3368},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170622-0400.pfx2as.gz", 3369},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170623-1200.pfx2as.gz", 3370},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170624-1200.pfx2as.gz", 3371},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170625-1200.pfx2as.gz", 3372},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170626-1200.pfx2as.gz", 3373},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170627-1200.pfx2as.gz", 3374},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170628-1200.pfx2as.gz", 3375},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170629-2200.pfx2as.gz", 3376},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170630-1000.pfx2as.gz", 3377},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170701-1200.pfx2as.gz", 3378},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170702-1200.pfx2as.gz", 3379},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170703-1000.pfx2as.gz", 3380},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170704-1200.pfx2as.gz", 3381},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170705-1200.pfx2as.gz", 3382},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170706-1200.pfx2as.gz", 3383},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170707-2000.pfx2as.gz", 3384},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170708-1400.pfx2as.gz", 3385},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170709-1200.pfx2as.gz", 3386},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170710-1200.pfx2as.gz", 3387},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170711-1200.pfx2as.gz", 3388},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170712-2000.pfx2as.gz", 3389},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170713-1200.pfx2as.gz", 3390},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170714-1400.pfx2as.gz", 3391},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170715-1200.pfx2as.gz", 3392},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170616-1200.pfx2as.gz", 3363, time.Unix(1497717708, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170617-1200.pfx2as.gz", 3364, time.Unix(1497803191, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170618-1000.pfx2as.gz", 3365, time.Unix(1497889838, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170619-1200.pfx2as.gz", 3366, time.Unix(1497976220, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170620-1200.pfx2as.gz", 3367, time.Unix(1498062848, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170621-1000.pfx2as.gz", 3368, time.Unix(1498149227, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170622-0400.pfx2as.gz", 3369, time.Unix(1498235751, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170623-1200.pfx2as.gz", 3370, time.Unix(1498321618, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170624-1200.pfx2as.gz", 3371, time.Unix(1498408147, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170625-1200.pfx2as.gz", 3372, time.Unix(1498494550, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170626-1200.pfx2as.gz", 3373, time.Unix(1498580169, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170627-1200.pfx2as.gz", 3374, time.Unix(1498667699, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170628-1200.pfx2as.gz", 3375, time.Unix(1498753979, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170629-2200.pfx2as.gz", 3376, time.Unix(1498840316, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/06/routeviews-rv2-20170630-1000.pfx2as.gz", 3377, time.Unix(1498926359, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170701-1200.pfx2as.gz", 3378, time.Unix(1499013879, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170702-1200.pfx2as.gz", 3379, time.Unix(1499100250, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170703-1000.pfx2as.gz", 3380, time.Unix(1499187237, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170704-1200.pfx2as.gz", 3381, time.Unix(1499273320, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170705-1200.pfx2as.gz", 3382, time.Unix(1499359329, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170706-1200.pfx2as.gz", 3383, time.Unix(1499445259, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170707-2000.pfx2as.gz", 3384, time.Unix(1499531673, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170708-1400.pfx2as.gz", 3385, time.Unix(1499617983, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170709-1200.pfx2as.gz", 3386, time.Unix(1499704095, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170710-1200.pfx2as.gz", 3387, time.Unix(1499790914, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170711-1200.pfx2as.gz", 3388, time.Unix(1499877213, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170712-2000.pfx2as.gz", 3389, time.Unix(1499963255, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170713-1200.pfx2as.gz", 3390, time.Unix(1500049445, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170714-1400.pfx2as.gz", 3391, time.Unix(1500135872, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170715-1200.pfx2as.gz", 3392, time.Unix(1500222389, 0).UTC()},
 		}},
 		{"", false, 3380, []urlAndSeqNum{
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170704-1200.pfx2as.gz", 3381},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170705-1200.pfx2as.gz", 3382},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170706-1200.pfx2as.gz", 3383},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170707-2000.pfx2as.gz", 3384},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170708-1400.pfx2as.gz", 3385},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170709-1200.pfx2as.gz", 3386},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170710-1200.pfx2as.gz", 3387},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170711-1200.pfx2as.gz", 3388},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170712-2000.pfx2as.gz", 3389},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170713-1200.pfx2as.gz", 3390},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170714-1400.pfx2as.gz", 3391},
-			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170715-1200.pfx2as.gz", 3392},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170704-1200.pfx2as.gz", 3381, time.Unix(1499273320, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170705-1200.pfx2as.gz", 3382, time.Unix(1499359329, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170706-1200.pfx2as.gz", 3383, time.Unix(1499445259, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170707-2000.pfx2as.gz", 3384, time.Unix(1499531673, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170708-1400.pfx2as.gz", 3385, time.Unix(1499617983, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170709-1200.pfx2as.gz", 3386, time.Unix(1499704095, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170710-1200.pfx2as.gz", 3387, time.Unix(1499790914, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170711-1200.pfx2as.gz", 3388, time.Unix(1499877213, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170712-2000.pfx2as.gz", 3389, time.Unix(1499963255, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170713-1200.pfx2as.gz", 3390, time.Unix(1500049445, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170714-1400.pfx2as.gz", 3391, time.Unix(1500135872, 0).UTC()},
+			{ts.URL[:strings.LastIndex(ts.URL, "/")+1] + "2017/07/routeviews-rv2-20170715-1200.pfx2as.gz", 3392, time.Unix(1500222389, 0).UTC()},
 		}},
 		{"", false, 4000, nil},
 		{"/error", true, 0, nil},
@@ -211,7 +238,7 @@ func TestGenRouteViewURLs(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		res, err := genRouteViewURLs(ts.URL+test.suffix, test.lastDownloaded)
+		res, err := genRouteViewURLs(context.Background(), ts.URL+test.suffix, test.lastDownloaded)
 		if !test.willErr {
 			if err != nil {
 				t.Errorf("genRouteViewURLs returned %s on %+v, %d.", err, res, test.lastDownloaded)
@@ -0,0 +1,125 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	conf "github.com/m-lab/downloader/config"
+	"github.com/m-lab/downloader/file"
+	"github.com/m-lab/downloader/metrics"
+	"github.com/m-lab/downloader/notify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Source is a dataset that the downloader keeps up to date. To add a
+// dataset, implement Source and Register it.
+type Source interface {
+	// Name uniquely identifies the source.
+	Name() string
+	// MetricLabel is the download_type label of the source's metrics.
+	MetricLabel() string
+	// Discover returns the files that should be fetched now, in the
+	// order they should be fetched.
+	Discover(ctx context.Context, store file.Store) ([]Candidate, error)
+	// Fetch downloads a single discovered file into the store.
+	Fetch(ctx context.Context, store file.Store, c Candidate) error
+}
+
+// Candidate is a single file found by Source.Discover.
+type Candidate struct {
+	URL string // The URL of the file to download
+	// For sources that publish a log of files, like Routeviews, the
+	// seqnum of the file in the log and of the candidate before it.
+	Seqnum     int
+	PrevSeqnum int
+	// When the file was published, if the source knows.
+	Published time.Time
+	// Whether the file is an old version found by a Backfiller, to be
+	// archived without touching current or the source's checkpoint.
+	Backfill bool
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []Source
+)
+
+// Register adds a Source to the set that the downloader runs. It panics
+// if a source with the same name is already registered.
+func Register(src Source) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, s := range registry {
+		if s.Name() == src.Name() {
+			panic("download: Register called twice for source " + src.Name())
+		}
+	}
+	registry = append(registry, src)
+}
+
+// Sources returns the registered sources in the order they were
+// registered.
+func Sources() []Source {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return append([]Source(nil), registry...)
+}
+
+// NewSource returns the Source that keeps ds up to date. n, if not nil,
+// is told about every new file the source keeps.
+func NewSource(ds conf.Dataset, n notify.Notifier) (Source, error) {
+	var src Source
+	var err error
+	switch ds.Kind {
+	case conf.KindMaxmind:
+		src, err = newMaxmindSource(ds, n)
+	case conf.KindRouteviews:
+		src, err = newRouteviewsSource(ds, n)
+	default:
+		return nil, fmt.Errorf("dataset %s has unknown kind %q", ds.Name, ds.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// resolveAuth returns the HTTP Basic Auth user and password that a
+// refers to.
+func resolveAuth(a conf.Auth) (string, string, error) {
+	user, err := conf.ResolveSecret(a.User)
+	if err != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Secret Error"}).Inc()
+		return "", "", err
+	}
+	pass, err := conf.ResolveSecret(a.Password)
+	if err != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Secret Error"}).Inc()
+		return "", "", err
+	}
+	return user, pass, nil
+}
+
+// Run discovers the files of src and fetches each of them into the
+// store. A file that fails does not stop the others from being
+// fetched. It returns the last error encountered, or nil on success. The
+// outcome is recorded in the Status of src.
+func Run(ctx context.Context, src Source, store file.Store) (err error) {
+	trackAttempt(src.Name())
+	defer func() { trackResult(src.Name(), err) }()
+	seedStatus(ctx, src, store)
+	candidates, err := src.Discover(ctx, store)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, c := range candidates {
+		if err := src.Fetch(ctx, store, c); err != nil {
+			lastErr = err
+			metrics.FailedDownloadCount.With(prometheus.Labels{"download_type": src.MetricLabel()}).Inc()
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,101 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	conf "github.com/m-lab/downloader/config"
+	"github.com/m-lab/downloader/file"
+)
+
+//// fakeSource records the candidates it is asked to fetch
+type fakeSource struct {
+	name        string
+	candidates  []Candidate
+	discoverErr error
+	failURL     string
+	fetched     []string
+}
+
+func (f *fakeSource) Name() string        { return f.name }
+func (f *fakeSource) MetricLabel() string { return f.name }
+
+func (f *fakeSource) Discover(context.Context, file.Store) ([]Candidate, error) {
+	return f.candidates, f.discoverErr
+}
+
+func (f *fakeSource) Fetch(_ context.Context, _ file.Store, c Candidate) error {
+	f.fetched = append(f.fetched, c.URL)
+	if c.URL == f.failURL {
+		return errors.New("Example Fetch Error")
+	}
+	return nil
+}
+
+func TestRegister(t *testing.T) {
+	defer func(saved []Source) { registry = saved }(registry)
+	registry = nil
+
+	a, b := &fakeSource{name: "a"}, &fakeSource{name: "b"}
+	Register(a)
+	Register(b)
+	if got := Sources(); !reflect.DeepEqual(got, []Source{a, b}) {
+		t.Errorf("Sources() = %v", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a duplicate name should panic")
+		}
+	}()
+	Register(&fakeSource{name: "a"})
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		src     *fakeSource
+		fetched []string
+		willErr bool
+	}{
+		{
+			src:     &fakeSource{candidates: []Candidate{{URL: "1"}, {URL: "2"}}},
+			fetched: []string{"1", "2"},
+		},
+		{
+			// A failure does not stop the remaining candidates.
+			src:     &fakeSource{candidates: []Candidate{{URL: "1"}, {URL: "2"}, {URL: "3"}}, failURL: "2"},
+			fetched: []string{"1", "2", "3"},
+			willErr: true,
+		},
+		{
+			src:     &fakeSource{candidates: []Candidate{{URL: "1"}}, discoverErr: errors.New("Example Discover Error")},
+			willErr: true,
+		},
+	}
+	for _, test := range tests {
+		err := Run(context.Background(), test.src, &testStore{map[string]*testFileObject{}})
+		if (err != nil) != test.willErr {
+			t.Errorf("Run() returned %v, expected error %t", err, test.willErr)
+		}
+		if !reflect.DeepEqual(test.src.fetched, test.fetched) {
+			t.Errorf("Run() fetched %v, expected %v", test.src.fetched, test.fetched)
+		}
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	for _, ds := range conf.Default().Datasets {
+		src, err := NewSource(ds, nil)
+		if err != nil {
+			t.Errorf("NewSource(%s) returned %v", ds.Name, err)
+			continue
+		}
+		if src.Name() != ds.Name || src.MetricLabel() != ds.MetricLabel {
+			t.Errorf("NewSource(%s) has name %s and label %s", ds.Name, src.Name(), src.MetricLabel())
+		}
+	}
+	if _, err := NewSource(conf.Dataset{Name: "x", Kind: "ftp"}, nil); err == nil {
+		t.Error("NewSource() of an unknown kind should fail")
+	}
+}
@@ -0,0 +1,19 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// statePrefix is where the downloader keeps its own bookkeeping objects in
+// the file.Store, well away from the datasets it archives.
+const statePrefix = "state/"
+
+// urlStateName returns the name of the state object of the given kind
+// that belongs to url. URLs contain characters that make poor object
+// names, so the name uses a hash of the URL instead, and the URL itself
+// should be saved inside the object.
+func urlStateName(kind string, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return statePrefix + kind + "/" + hex.EncodeToString(sum[:]) + ".json"
+}
@@ -0,0 +1,180 @@
+package download
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/m-lab/downloader/file"
+	"github.com/m-lab/downloader/metrics"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxVersionHistory is how many versions of a dataset are remembered.
+const maxVersionHistory = 365
+
+// VersionStats describes one kept version of a dataset, to compare it
+// with the next.
+type VersionStats struct {
+	Object   string    `json:"object"`
+	Time     time.Time `json:"time"`
+	Bytes    int64     `json:"bytes"`
+	Records  int64     `json:"records,omitempty"`  // Lines, or search tree nodes of a database.
+	Prefixes int64     `json:"prefixes,omitempty"` // Distinct IP prefixes.
+}
+
+// versionHistory is the stats of the last versions of a dataset, oldest
+// first.
+type versionHistory struct {
+	Versions []VersionStats `json:"versions"`
+}
+
+// Counter fills in the Records and Prefixes of a version from its
+// content. Counters are chosen by the kind of the dataset.
+type Counter func(r io.Reader, s *VersionStats) error
+
+// versionHistoryName returns the name of the state object holding the
+// history of dataset.
+func versionHistoryName(dataset string) string {
+	return statePrefix + "stats/" + strings.Trim(dataset, "/") + ".json"
+}
+
+// loadVersionHistory returns the history of dataset, which is empty if
+// no version has been kept yet.
+func loadVersionHistory(ctx context.Context, store file.Store, dataset string) (*versionHistory, error) {
+	h := &versionHistory{}
+	err := file.ReadJSON(ctx, store, versionHistoryName(dataset), h)
+	if err != nil && err != file.ErrNotExist {
+		return nil, err
+	}
+	return h, nil
+}
+
+// latest returns the stats of the last version, or nil if there is none.
+func (h *versionHistory) latest() *VersionStats {
+	if len(h.Versions) == 0 {
+		return nil
+	}
+	return &h.Versions[len(h.Versions)-1]
+}
+
+// addToVersionHistory records that s is the latest version of dataset.
+func addToVersionHistory(ctx context.Context, store file.Store, dataset string, s VersionStats) error {
+	h, err := loadVersionHistory(ctx, store, dataset)
+	if err != nil {
+		return err
+	}
+	h.Versions = append(h.Versions, s)
+	if len(h.Versions) > maxVersionHistory {
+		h.Versions = h.Versions[len(h.Versions)-maxVersionHistory:]
+	}
+	return file.WriteJSON(ctx, store, versionHistoryName(dataset), h)
+}
+
+// versionStats returns the stats of obj, the new version filename.
+func versionStats(ctx context.Context, dc config, obj file.Object, filename string, size int64) (*VersionStats, error) {
+	s := &VersionStats{Object: filename, Time: time.Now().UTC(), Bytes: size}
+	if dc.Counter == nil {
+		return s, nil
+	}
+	r, err := obj.GetReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return s, dc.Counter(r, s)
+}
+
+// deltaPercent returns how much cur differs from prev, as a percentage
+// of prev. It is 0 if there is nothing to compare with, and -100 if cur
+// is empty but prev was not.
+func deltaPercent(prev int64, cur int64) float64 {
+	if prev == 0 {
+		return 0
+	}
+	return float64(cur-prev) * 100 / float64(prev)
+}
+
+// checkDeltas exports how much cur differs from prev, and returns an
+// error if any stat changed by more than maxPercent. A maxPercent of 0
+// allows any change.
+func checkDeltas(dataset string, prev *VersionStats, cur *VersionStats, maxPercent float64) error {
+	if prev == nil {
+		return nil
+	}
+	var tooBig []string
+	for _, d := range []struct {
+		stat      string
+		prev, cur int64
+	}{
+		{"bytes", prev.Bytes, cur.Bytes},
+		{"records", prev.Records, cur.Records},
+		{"prefixes", prev.Prefixes, cur.Prefixes},
+	} {
+		delta := deltaPercent(d.prev, d.cur)
+		metrics.VersionDeltaPercent.With(prometheus.Labels{"dataset": dataset, "stat": d.stat}).Set(delta)
+		if maxPercent > 0 && math.Abs(delta) > maxPercent {
+			tooBig = append(tooBig, fmt.Sprintf("%s changed by %.1f%% from %d to %d", d.stat, delta, d.prev, d.cur))
+		}
+	}
+	if len(tooBig) > 0 {
+		return fmt.Errorf("compared to %s, %s, more than the allowed %g%%", prev.Object, strings.Join(tooBig, " and "), maxPercent)
+	}
+	return nil
+}
+
+// countPfx2as counts the lines and distinct prefixes of a gzipped
+// Routeviews prefix to AS file.
+func countPfx2as(r io.Reader, s *VersionStats) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	prefixes := map[string]bool{}
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		s.Records++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) >= 2 {
+			prefixes[fields[0]+"/"+fields[1]] = true
+		}
+	}
+	s.Prefixes = int64(len(prefixes))
+	return scanner.Err()
+}
+
+// countMMDB counts the search tree nodes of the .mmdb database in a
+// MaxMind tarball.
+func countMMDB(r io.Reader, s *VersionStats) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(hdr.Name, ".mmdb") {
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(tr, maxMMDBSize))
+		if err != nil {
+			return err
+		}
+		db, err := maxminddb.FromBytes(b)
+		if err != nil {
+			return err
+		}
+		s.Records = int64(db.Metadata.NodeCount)
+		return nil
+	}
+}
@@ -0,0 +1,217 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/downloader/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCountPfx2as(t *testing.T) {
+	s := &VersionStats{}
+	err := countPfx2as(bytes.NewReader(gzipped("1.0.0.0\t24\t13335\n1.0.0.0\t24\t4\n1.0.4.0\t22\t38803\n")), s)
+	if err != nil || s.Records != 3 || s.Prefixes != 2 {
+		t.Errorf("countPfx2as() = %+v, %v", s, err)
+	}
+}
+
+func TestCountMMDB(t *testing.T) {
+	s := &VersionStats{}
+	err := countMMDB(bytes.NewReader(tarball(map[string][]byte{"x/GeoLite2-ASN.mmdb": testMMDB("GeoLite2-ASN", 6, time.Now())})), s)
+	if err != nil || s.Records != 1 {
+		t.Errorf("countMMDB() = %+v, %v", s, err)
+	}
+}
+
+func TestCheckDeltas(t *testing.T) {
+	prev := &VersionStats{Object: "old", Bytes: 1000, Records: 100, Prefixes: 50}
+	tests := []struct {
+		cur     VersionStats
+		max     float64
+		errText string
+	}{
+		{cur: VersionStats{Bytes: 1050, Records: 95, Prefixes: 50}, max: 10},
+		{cur: VersionStats{Bytes: 500, Records: 50, Prefixes: 50}, max: 0},
+		{cur: VersionStats{Bytes: 1000, Records: 100, Prefixes: 25}, max: 10, errText: "prefixes changed by -50.0% from 50 to 25"},
+		{cur: VersionStats{Bytes: 1000, Records: 0, Prefixes: 50}, max: 10, errText: "records changed by -100.0% from 100 to 0"},
+		{cur: VersionStats{Bytes: 2000, Records: 100, Prefixes: 50}, max: 10, errText: "compared to old, bytes changed by 100.0%"},
+	}
+	for _, test := range tests {
+		err := checkDeltas("test", prev, &test.cur, test.max)
+		if (err == nil) != (test.errText == "") || (err != nil && !strings.Contains(err.Error(), test.errText)) {
+			t.Errorf("checkDeltas(%+v, %g) = %v, expected %q", test.cur, test.max, err, test.errText)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.VersionDeltaPercent.WithLabelValues("test", "bytes")); got != 100 {
+		t.Errorf("The bytes delta gauge is %g, expected 100", got)
+	}
+	if err := checkDeltas("test", nil, prev, 10); err != nil {
+		t.Errorf("The first version should always pass, got %v", err)
+	}
+}
+
+func TestDownloadRefusesBigDeltas(t *testing.T) {
+	ctx := context.Background()
+	body := gzipped("1.0.0.0\t24\t13335\n1.0.4.0\t22\t38803\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+	dc := config{
+		Store:           fs,
+		PathPrefix:      "RouteViewIPv4/",
+		CurrentName:     "RouteViewIPv4/current/routeview.pfx2as.gz",
+		URLRegexp:       routeviewsURLToFilenameRegexp,
+		DedupRegexp:     routeviewsFilenameToDedupeRegexp,
+		MaxDuration:     time.Minute,
+		Validators:      []Validator{validatePfx2as},
+		Counter:         countPfx2as,
+		MaxDeltaPercent: 10,
+		Dataset:         "routeviews-v4",
+	}
+	dc.URL = ts.URL + "/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz"
+	if err := download(ctx, dc); err.error != nil {
+		t.Fatalf("download() of the first version returned %v", err)
+	}
+
+	// Half of the prefixes disappear.
+	body = gzipped("1.0.0.0\t24\t13335\n")
+	dc.URL = ts.URL + "/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz"
+	if err := download(ctx, dc); err.error == nil || !err.permanent {
+		t.Fatalf("download() returned %+v, expected a permanent error", err)
+	}
+	if _, ok := fs.files["RouteViewIPv4/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz"]; ok {
+		t.Error("The half-empty version was kept")
+	}
+	items, _ := ListQuarantined(ctx, fs, "routeviews-v4")
+	if len(items) != 1 || !strings.Contains(items[0].Reason, "prefixes changed by -50.0%") {
+		t.Fatalf("Expected the half-empty version in quarantine, got %+v", items)
+	}
+
+	// Releasing it forces it, and makes it the version to compare with.
+	if _, promoted, err := ReleaseQuarantined(ctx, fs, items[0].Name); err != nil || !promoted {
+		t.Fatalf("ReleaseQuarantined() returned %v, %v, expected it to promote the file", promoted, err)
+	}
+	history, err := loadVersionHistory(ctx, fs, "routeviews-v4")
+	if err != nil || len(history.Versions) != 2 || history.latest().Prefixes != 1 ||
+		history.latest().Object != "RouteViewIPv4/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz" {
+		t.Errorf("Version history is %+v, %v", history, err)
+	}
+	body = gzipped("1.0.0.0\t24\t13336\n")
+	dc.URL = ts.URL + "/2017/06/routeviews-rv2-20170618-1200.pfx2as.gz"
+	if err := download(ctx, dc); err.error != nil {
+		t.Errorf("download() after the release returned %v", err)
+	}
+	if history, _ := loadVersionHistory(ctx, fs, "routeviews-v4"); len(history.Versions) != 3 {
+		t.Errorf("The version after the release was not kept: %+v", history)
+	}
+}
+
+func TestReleaseQuarantinedKeepsNewerCurrent(t *testing.T) {
+	ctx := context.Background()
+	body := gzipped("1.0.0.0\t24\t13335\n1.0.4.0\t22\t38803\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+	dc := config{
+		Store:           fs,
+		PathPrefix:      "RouteViewIPv4/",
+		CurrentName:     "RouteViewIPv4/current/routeview.pfx2as.gz",
+		URLRegexp:       routeviewsURLToFilenameRegexp,
+		DedupRegexp:     routeviewsFilenameToDedupeRegexp,
+		MaxDuration:     time.Minute,
+		Validators:      []Validator{validatePfx2as},
+		Counter:         countPfx2as,
+		MaxDeltaPercent: 10,
+		Dataset:         "routeviews-v4",
+	}
+	dc.URL = ts.URL + "/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz"
+	if err := download(ctx, dc); err.error != nil {
+		t.Fatalf("download() of the first version returned %v", err)
+	}
+	body = gzipped("1.0.0.0\t24\t13335\n")
+	dc.URL = ts.URL + "/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz"
+	if err := download(ctx, dc); err.error == nil {
+		t.Fatal("download() kept the half-empty version")
+	}
+	// A newer version is kept before the rejected one is released.
+	body = gzipped("1.0.0.0\t24\t13336\n1.0.4.0\t22\t38803\n")
+	dc.URL = ts.URL + "/2017/06/routeviews-rv2-20170618-1200.pfx2as.gz"
+	if err := download(ctx, dc); err.error != nil {
+		t.Fatalf("download() of the newer version returned %v", err)
+	}
+	items, _ := ListQuarantined(ctx, fs, "routeviews-v4")
+	if len(items) != 1 {
+		t.Fatalf("Expected the half-empty version in quarantine, got %+v", items)
+	}
+
+	q, promoted, err := ReleaseQuarantined(ctx, fs, items[0].Name)
+	if err != nil || promoted {
+		t.Fatalf("ReleaseQuarantined() returned %v, %v, expected it not to promote the file", promoted, err)
+	}
+	if _, ok := fs.files[q.ArchiveName]; !ok {
+		t.Errorf("%s was not released to the archive", q.ArchiveName)
+	}
+	newer := fs.files["RouteViewIPv4/2017/06/routeviews-rv2-20170618-1200.pfx2as.gz"]
+	if current := fs.files[dc.CurrentName]; !bytes.Equal(current.md5, newer.md5) {
+		t.Error("Releasing the older version replaced the newer one in current")
+	}
+	history, err := loadVersionHistory(ctx, fs, "routeviews-v4")
+	if err != nil || len(history.Versions) != 2 || history.latest().Object != newer.name {
+		t.Errorf("Version history is %+v, %v, expected the newer version to stay the latest", history, err)
+	}
+}
+
+func TestDownloadForcesBigDeltas(t *testing.T) {
+	ctx := context.Background()
+	body := gzipped("1.0.0.0\t24\t13335\n1.0.4.0\t22\t38803\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+	dc := config{
+		Store:           fs,
+		PathPrefix:      "RouteViewIPv4/",
+		CurrentName:     "RouteViewIPv4/current/routeview.pfx2as.gz",
+		URLRegexp:       routeviewsURLToFilenameRegexp,
+		DedupRegexp:     routeviewsFilenameToDedupeRegexp,
+		MaxDuration:     time.Minute,
+		Counter:         countPfx2as,
+		MaxDeltaPercent: 10,
+		Force:           true,
+		Dataset:         "routeviews-v4",
+	}
+	dc.URL = ts.URL + "/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz"
+	if err := download(ctx, dc); err.error != nil {
+		t.Fatalf("download() of the first version returned %v", err)
+	}
+
+	// Half of the prefixes disappear, but the file is kept anyway.
+	body = gzipped("1.0.0.0\t24\t13335\n")
+	dc.URL = ts.URL + "/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz"
+	if err := download(ctx, dc); err.error != nil {
+		t.Fatalf("download() returned %v, expected the change to be forced", err)
+	}
+	if _, ok := fs.files["RouteViewIPv4/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz"]; !ok {
+		t.Error("The forced version was not kept")
+	}
+	if items, _ := ListQuarantined(ctx, fs, ""); len(items) != 0 {
+		t.Errorf("The forced version was quarantined: %+v", items)
+	}
+	if history, _ := loadVersionHistory(ctx, fs, "routeviews-v4"); history.latest().Prefixes != 1 {
+		t.Errorf("The forced version is not the latest: %+v", history)
+	}
+	if got := testutil.ToFloat64(metrics.VersionDeltaPercent.WithLabelValues("routeviews-v4", "prefixes")); got != -50 {
+		t.Errorf("The prefixes delta gauge is %g, expected -50", got)
+	}
+}
@@ -0,0 +1,171 @@
+package download
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/m-lab/downloader/file"
+	"github.com/m-lab/downloader/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Status is what is known about the recent runs of a source, since the
+// downloader started. The files kept before that are read from the
+// store when the source is first run.
+type Status struct {
+	Source      string    `json:"source"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	// When the last error happened. It may be older than the last success.
+	LastErrorTime time.Time `json:"last_error_time"`
+	// The last new file that was kept.
+	LastObject string `json:"last_object,omitempty"`
+	// The current name of the source, and the object last copied to it.
+	CurrentName   string `json:"current_name,omitempty"`
+	CurrentTarget string `json:"current_target,omitempty"`
+	// The checkpointed seqnum, for sources that publish a log of files.
+	Seqnum int `json:"seqnum,omitempty"`
+	// When the source is next scheduled to run, if that is known. It is
+	// filled in by the scheduler's caller, not by this package.
+	NextRun time.Time `json:"next_run"`
+}
+
+var (
+	statusMu sync.Mutex
+	statuses = map[string]*Status{}
+	// The sources whose Status was seeded from the store.
+	seeded = map[string]bool{}
+)
+
+// currentNamer is a Source that copies its newest file to a current name.
+type currentNamer interface {
+	currentName() string
+}
+
+// Statuses returns the Status of every registered source, in the order
+// they were registered, followed by those of the other sources that were
+// run, by name.
+func Statuses() []Status {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	var list []Status
+	seen := map[string]bool{}
+	for _, src := range Sources() {
+		seen[src.Name()] = true
+		if s, ok := statuses[src.Name()]; ok {
+			list = append(list, *s)
+		} else {
+			list = append(list, Status{Source: src.Name()})
+		}
+	}
+	var others []string
+	for name := range statuses {
+		if !seen[name] {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		list = append(list, *statuses[name])
+	}
+	return list
+}
+
+// updateStatus calls update on the Status of the source named name.
+func updateStatus(name string, update func(s *Status)) {
+	if name == "" {
+		return
+	}
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	s, ok := statuses[name]
+	if !ok {
+		s = &Status{Source: name}
+		statuses[name] = s
+	}
+	update(s)
+}
+
+// trackAttempt records that a run of the source named name started.
+func trackAttempt(name string) {
+	metrics.DatasetLastAttemptTime.With(prometheus.Labels{"dataset": name}).SetToCurrentTime()
+	updateStatus(name, func(s *Status) { s.LastAttempt = time.Now().UTC() })
+}
+
+// seedStatus fills in the last file src kept, and where it was copied
+// to, from the version history in store, the first time src is run. A
+// file kept since is not overwritten.
+func seedStatus(ctx context.Context, src Source, store file.Store) {
+	statusMu.Lock()
+	done := seeded[src.Name()]
+	seeded[src.Name()] = true
+	statusMu.Unlock()
+	if done {
+		return
+	}
+	history, err := loadVersionHistory(ctx, store, src.Name())
+	if err != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Version Stats Error"}).Inc()
+		return
+	}
+	latest := history.latest()
+	if latest == nil {
+		return
+	}
+	currentName := ""
+	if c, ok := src.(currentNamer); ok {
+		currentName = c.currentName()
+	}
+	updateStatus(src.Name(), func(s *Status) {
+		if s.LastObject != "" {
+			return
+		}
+		s.LastObject = latest.Object
+		if currentName != "" {
+			s.CurrentName, s.CurrentTarget = currentName, latest.Object
+		}
+	})
+}
+
+// trackResult records how a run of the source named name ended.
+func trackResult(name string, err error) {
+	if err == nil {
+		metrics.DatasetLastSuccessTime.With(prometheus.Labels{"dataset": name}).SetToCurrentTime()
+	}
+	updateStatus(name, func(s *Status) {
+		if err != nil {
+			s.LastError, s.LastErrorTime = err.Error(), time.Now().UTC()
+			return
+		}
+		s.LastSuccess = time.Now().UTC()
+	})
+}
+
+// trackKept records that the source named name kept the new file object,
+// and copied it to currentName, unless that is empty.
+func trackKept(name string, object string, currentName string) {
+	metrics.DatasetLastNewFileTime.With(prometheus.Labels{"dataset": name}).SetToCurrentTime()
+	updateStatus(name, func(s *Status) {
+		s.LastObject = object
+		if currentName != "" {
+			s.CurrentName, s.CurrentTarget = currentName, object
+		}
+	})
+}
+
+// trackCheckpoint records the checkpointed seqnum of the source named name.
+func trackCheckpoint(name string, seqnum int) {
+	updateStatus(name, func(s *Status) { s.Seqnum = seqnum })
+}
+
+// trackPublished records when the newest file held of the source named
+// name was published upstream.
+func trackPublished(name string, published time.Time) {
+	if name == "" || published.IsZero() {
+		return
+	}
+	metrics.DatasetDataAge.SetPublished(name, published)
+}
@@ -0,0 +1,159 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/m-lab/downloader/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStatuses(t *testing.T) {
+	logUp := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pfx2as-creation.log":
+			if !logUp {
+				http.Error(w, "down", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, `3363	1497717708	2017/06/routeviews-rv2-20170616-1200.pfx2as.gz
+3364	1497803191	2017/06/routeviews-rv2-20170617-1200.pfx2as.gz`)
+		case "/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz":
+			w.Write(gzipped("1.0.0.0\t24\t13335\n"))
+		case "/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz":
+			w.Write(gzipped("1.0.0.0\t24\t13335\n1.0.1.0\t24\t13335\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+	status := func() Status {
+		for _, s := range Statuses() {
+			if s.Source == "StatusTest/" {
+				return s
+			}
+		}
+		t.Fatal("Statuses() has no status for StatusTest/")
+		return Status{}
+	}
+
+	err := CaidaRouteviewsFiles(context.Background(), ts.URL+"/pfx2as-creation.log", "StatusTest/", "StatusTest/current/routeview.pfx2as.gz", fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := status()
+	if s.LastAttempt.IsZero() || s.LastSuccess.IsZero() || s.LastError != "" {
+		t.Errorf("After a success, the status is %+v", s)
+	}
+	if s.LastObject != "StatusTest/2017/06/routeviews-rv2-20170617-1200.pfx2as.gz" || s.CurrentTarget != s.LastObject ||
+		s.CurrentName != "StatusTest/current/routeview.pfx2as.gz" {
+		t.Errorf("After a success, the status is %+v, expected the last file to be current", s)
+	}
+	if s.Seqnum != 3364 {
+		t.Errorf("After a success, the seqnum is %d, expected 3364", s.Seqnum)
+	}
+
+	if age := gaugeValue(t, "downloader_dataset_data_age_seconds", "StatusTest/"); age < time.Since(time.Unix(1497803191, 0)).Seconds()-60 {
+		t.Errorf("The data age is %vs, expected the age of the last file in the log", age)
+	}
+	for _, name := range []string{"downloader_dataset_last_attempt_time_seconds", "downloader_dataset_last_success_time_seconds", "downloader_dataset_last_new_file_time_seconds"} {
+		if v := gaugeValue(t, name, "StatusTest/"); v < float64(s.LastAttempt.Unix()-60) {
+			t.Errorf("%s is %v, expected about %d", name, v, s.LastAttempt.Unix())
+		}
+	}
+
+	logUp = false
+	if err := CaidaRouteviewsFiles(context.Background(), ts.URL+"/pfx2as-creation.log", "StatusTest/", "StatusTest/current/routeview.pfx2as.gz", fs); err == nil {
+		t.Fatal("CaidaRouteviewsFiles() succeeded without a log")
+	}
+	failed := status()
+	if failed.LastError == "" || failed.LastErrorTime.IsZero() || !failed.LastSuccess.Equal(s.LastSuccess) || failed.LastObject != s.LastObject {
+		t.Errorf("After a failure, the status is %+v", failed)
+	}
+}
+
+// gaugeValue returns the value of the gauge called name for dataset.
+func gaugeValue(t *testing.T, name string, dataset string) float64 {
+	samples, err := metrics.Gather(name, prometheus.Labels{"dataset": dataset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("There are %d %s for %s, expected 1", len(samples), name, dataset)
+	}
+	return samples[0].Value
+}
+
+func TestDataAgeFromLastModified(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", "Tue, 01 Jun 2021 00:00:00 GMT")
+		fmt.Fprint(w, "Stuff")
+	}))
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+	dc := config{
+		URL:                     ts.URL + "/download?suffix=tar.gz",
+		Store:                   fs,
+		PathPrefix:              "pre/",
+		FixedFilename:           "file.tar.gz",
+		DedupRegexp:             regexp.MustCompile(`(pre/)`),
+		MaxDuration:             time.Minute,
+		Conditional:             true,
+		Dataset:                 "DataAgeTest",
+		LastModifiedIsPublished: true,
+	}
+	if err := download(context.Background(), dc); err.error != nil {
+		t.Fatal(err)
+	}
+	published := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	if age := gaugeValue(t, "downloader_dataset_data_age_seconds", "DataAgeTest"); age < time.Since(published).Seconds()-60 {
+		t.Errorf("The data age is %vs, expected the age of the Last-Modified header", age)
+	}
+	// The 304 has no Last-Modified, so the age comes from the saved validators.
+	metrics.DatasetDataAge.SetPublished("DataAgeTest", time.Now())
+	if err := download(context.Background(), dc); err.error != nil {
+		t.Fatal(err)
+	}
+	if age := gaugeValue(t, "downloader_dataset_data_age_seconds", "DataAgeTest"); age < time.Since(published).Seconds()-60 {
+		t.Errorf("The data age is %vs after a 304, expected the age of the saved Last-Modified", age)
+	}
+}
+
+func TestStatusSeededFromStore(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	fs := &testStore{map[string]*testFileObject{}}
+	// What a previous downloader kept.
+	kept := VersionStats{Object: "SeedTest/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz", Time: time.Now().UTC()}
+	if err := addToVersionHistory(context.Background(), fs, "SeedTest/", kept); err != nil {
+		t.Fatal(err)
+	}
+	src, err := caidaRouteviewsSource(ts.URL+"/pfx2as-creation.log", "SeedTest/", "SeedTest/current/routeview.pfx2as.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(context.Background(), src, fs); err == nil {
+		t.Fatal("Run() succeeded without a log")
+	}
+	for _, s := range Statuses() {
+		if s.Source != "SeedTest/" {
+			continue
+		}
+		if s.LastObject != kept.Object || s.CurrentTarget != kept.Object || s.CurrentName != "SeedTest/current/routeview.pfx2as.gz" {
+			t.Errorf("After a restart, the status is %+v, expected the file kept before", s)
+		}
+		return
+	}
+	t.Error("Statuses() has no status for SeedTest/")
+}
@@ -0,0 +1,169 @@
+package download
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Validator checks the content of a downloaded file before it is copied
+// to current. It returns why the file is unfit for use, or nil if it is
+// fine.
+type Validator func(r io.Reader) error
+
+// validators are the built-in Validators, by the name they are given in
+// a dataset's config.
+var validators = map[string]Validator{
+	"gzip":   validateGzip,
+	"mmdb":   validateMMDB,
+	"pfx2as": validatePfx2as,
+}
+
+// lookupValidators returns the built-in Validators with the given names.
+func lookupValidators(names []string) ([]Validator, error) {
+	var vs []Validator
+	for _, name := range names {
+		v, ok := validators[name]
+		if !ok {
+			var known []string
+			for k := range validators {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown validator %q, must be one of %s", name, strings.Join(known, ", "))
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// validateGzip checks that r is a complete gzip file, catching truncated
+// downloads and HTML error pages.
+func validateGzip(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(io.Discard, gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// maxMMDBSize bounds how much of an .mmdb file is read into memory.
+const maxMMDBSize = 1 << 30
+
+// The first database MaxMind built in the current format, to catch
+// metadata with a nonsense build time.
+var earliestMMDBBuild = time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// validateMMDB checks that r is a gzipped tarball, as MaxMind publishes
+// them, containing an .mmdb database that can be opened and has sane
+// metadata.
+func validateMMDB(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("the tarball contains no .mmdb file")
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(hdr.Name, ".mmdb") {
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(tr, maxMMDBSize))
+		if err != nil {
+			return err
+		}
+		db, err := maxminddb.FromBytes(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		if err := checkMMDBMetadata(db.Metadata); err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		return nil
+	}
+}
+
+// checkMMDBMetadata returns an error if m could not describe a real
+// MaxMind database.
+func checkMMDBMetadata(m maxminddb.Metadata) error {
+	if m.BinaryFormatMajorVersion != 2 {
+		return fmt.Errorf("unsupported binary format version %d", m.BinaryFormatMajorVersion)
+	}
+	if m.DatabaseType == "" {
+		return errors.New("the database type is empty")
+	}
+	if m.IPVersion != 4 && m.IPVersion != 6 {
+		return fmt.Errorf("invalid IP version %d", m.IPVersion)
+	}
+	if m.NodeCount == 0 {
+		return errors.New("the search tree is empty")
+	}
+	built := time.Unix(int64(m.BuildEpoch), 0)
+	if built.Before(earliestMMDBBuild) || built.After(time.Now().Add(24*time.Hour)) {
+		return fmt.Errorf("implausible build time %s", built.UTC())
+	}
+	return nil
+}
+
+var pfx2asASNRegexp = regexp.MustCompile(`^\d+([_,]\d+)*$`)
+
+// validatePfx2as checks that r is a gzipped Routeviews prefix to AS file,
+// with at least one line, and that every line is a prefix, a prefix
+// length and an AS number, separated by tabs. Multi-origin ASes are
+// separated by "_" and AS sets by ",".
+func validatePfx2as(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(gz)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			return fmt.Errorf("line %d: expected 3 tab separated fields, got %q", lines, scanner.Text())
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return fmt.Errorf("line %d: invalid prefix %q", lines, fields[0])
+		}
+		maxLength := 128
+		if ip.To4() != nil {
+			maxLength = 32
+		}
+		if length, err := strconv.Atoi(fields[1]); err != nil || length < 0 || length > maxLength {
+			return fmt.Errorf("line %d: invalid prefix length %q", lines, fields[1])
+		}
+		if !pfx2asASNRegexp.MatchString(fields[2]) {
+			return fmt.Errorf("line %d: invalid AS number %q", lines, fields[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if lines == 0 {
+		return errors.New("the file has no prefixes")
+	}
+	return gz.Close()
+}
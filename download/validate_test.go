@@ -0,0 +1,154 @@
+package download
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gzipped returns s, gzipped.
+func gzipped(s string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.Bytes()
+}
+
+// tarball returns a gzipped tarball of the given files.
+func tarball(files map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// mmdbString encodes s in the MaxMind DB data format.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbUint32 encodes n in the MaxMind DB data format.
+func mmdbUint32(n uint32) []byte {
+	b := []byte{6<<5 | 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], n)
+	return b
+}
+
+// mmdbUint64 encodes n in the MaxMind DB data format.
+func mmdbUint64(n uint64) []byte {
+	b := []byte{8, 9 - 7, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[2:], n)
+	return b
+}
+
+// testMMDB returns the smallest database maxminddb can open: a search
+// tree of one empty node, an empty data section and the metadata.
+func testMMDB(databaseType string, ipVersion uint32, built time.Time) []byte {
+	db := []byte{0, 0, 1, 0, 0, 1}       // One node, whose records point past the tree.
+	db = append(db, make([]byte, 16)...) // The data section separator.
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, 7<<5|7) // A map of 7 entries.
+	db = append(db, mmdbString("binary_format_major_version")...)
+	db = append(db, mmdbUint32(2)...)
+	db = append(db, mmdbString("binary_format_minor_version")...)
+	db = append(db, mmdbUint32(0)...)
+	db = append(db, mmdbString("build_epoch")...)
+	db = append(db, mmdbUint64(uint64(built.Unix()))...)
+	db = append(db, mmdbString("database_type")...)
+	db = append(db, mmdbString(databaseType)...)
+	db = append(db, mmdbString("ip_version")...)
+	db = append(db, mmdbUint32(ipVersion)...)
+	db = append(db, mmdbString("node_count")...)
+	db = append(db, mmdbUint32(1)...)
+	db = append(db, mmdbString("record_size")...)
+	db = append(db, mmdbUint32(24)...)
+	return db
+}
+
+func TestValidators(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		validator string
+		data      []byte
+		errText   string
+	}{
+		{name: "gzip", validator: "gzip", data: gzipped("Stuff")},
+		{name: "gzip truncated", validator: "gzip", data: gzipped("Stuff")[:20], errText: "unexpected EOF"},
+		{name: "gzip html", validator: "gzip", data: []byte("<html>Error</html>"), errText: "invalid header"},
+		{
+			name:      "mmdb",
+			validator: "mmdb",
+			data:      tarball(map[string][]byte{"GeoLite2-City_20240501/GeoLite2-City.mmdb": testMMDB("GeoLite2-City", 6, now)}),
+		},
+		{
+			name:      "mmdb missing",
+			validator: "mmdb",
+			data:      tarball(map[string][]byte{"GeoLite2-City_20240501/README.txt": []byte("Stuff")}),
+			errText:   "no .mmdb file",
+		},
+		{
+			name:      "mmdb garbage",
+			validator: "mmdb",
+			data:      tarball(map[string][]byte{"GeoLite2-City.mmdb": []byte("Stuff")}),
+			errText:   "invalid MaxMind DB file",
+		},
+		{
+			name:      "mmdb no type",
+			validator: "mmdb",
+			data:      tarball(map[string][]byte{"GeoLite2-City.mmdb": testMMDB("", 6, now)}),
+			errText:   "database type is empty",
+		},
+		{
+			name:      "mmdb bad ip version",
+			validator: "mmdb",
+			data:      tarball(map[string][]byte{"GeoLite2-City.mmdb": testMMDB("GeoLite2-City", 5, now)}),
+			errText:   "invalid IP version 5",
+		},
+		{
+			name:      "mmdb bad build time",
+			validator: "mmdb",
+			data:      tarball(map[string][]byte{"GeoLite2-City.mmdb": testMMDB("GeoLite2-City", 6, now.AddDate(1, 0, 0))}),
+			errText:   "implausible build time",
+		},
+		{
+			name:      "pfx2as",
+			validator: "pfx2as",
+			data:      gzipped("1.0.0.0\t24\t13335\n2001:200::\t32\t2500\n1.0.4.0\t22\t38803_56203\n1.6.0.0\t15\t9583,1234\n"),
+		},
+		{name: "pfx2as empty", validator: "pfx2as", data: gzipped(""), errText: "no prefixes"},
+		{name: "pfx2as fields", validator: "pfx2as", data: gzipped("1.0.0.0 24 13335\n"), errText: "line 1: expected 3"},
+		{name: "pfx2as prefix", validator: "pfx2as", data: gzipped("1.0.0\t24\t13335\n"), errText: "invalid prefix"},
+		{name: "pfx2as length", validator: "pfx2as", data: gzipped("1.0.0.0\t33\t13335\n"), errText: "invalid prefix length"},
+		{name: "pfx2as asn", validator: "pfx2as", data: gzipped("1.0.0.0\t24\tAS13335\n"), errText: "invalid AS number"},
+	}
+	for _, test := range tests {
+		err := validators[test.validator](bytes.NewReader(test.data))
+		if test.errText == "" && err != nil {
+			t.Errorf("%s: returned %v", test.name, err)
+		}
+		if test.errText != "" && (err == nil || !strings.Contains(err.Error(), test.errText)) {
+			t.Errorf("%s: returned %v, expected an error containing %q", test.name, err, test.errText)
+		}
+	}
+}
+
+func TestLookupValidators(t *testing.T) {
+	if vs, err := lookupValidators([]string{"gzip", "pfx2as"}); err != nil || len(vs) != 2 {
+		t.Errorf("lookupValidators() = %v, %v", vs, err)
+	}
+	if _, err := lookupValidators([]string{"gzip", "zip"}); err == nil || !strings.Contains(err.Error(), `unknown validator "zip"`) {
+		t.Errorf("lookupValidators() returned %v", err)
+	}
+}
@@ -1,8 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/m-lab/go/flagx"
@@ -10,106 +21,438 @@ import (
 
 	"golang.org/x/net/context"
 
+	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/m-lab/downloader/admin"
+	conf "github.com/m-lab/downloader/config"
 	"github.com/m-lab/downloader/download"
 	"github.com/m-lab/downloader/file"
 	"github.com/m-lab/downloader/metrics"
+	"github.com/m-lab/downloader/notify"
+	"github.com/m-lab/downloader/scheduler"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// The average time (in hours) to wait in between attempts to download
-// files
-const averageHoursBetweenUpdateChecks = 24 * time.Hour
-
-// The window of time (in hours) to allow a random time to be chosen
-// from.
-const windowForRandomTimeBetweenUpdateChecks = 4 * time.Hour
-
 var (
 	mainCtx, mainCancel = context.WithCancel(context.Background())
+
+	s3Endpoint = flag.String("s3_endpoint", "", "The endpoint of an S3-compatible service such as MinIO. Defaults to AWS.")
 )
 
 // The main function seeds the random number generator, starts
 // prometheus in the background, takes the bucket flag from the
-// command line, and kicks off the actual downloader loop
+// command line, and kicks off the actual downloader loop. SIGTERM and
+// SIGINT stop the loop, after giving the downloads in flight a chance to
+// finish.
 func main() {
 	defer mainCancel()
 
 	bucketName := flag.String("bucket", "", "Specify the bucket name to store the results in.")
+	storeURL := flag.String("store", "", "Specify where to store the results as a URL, e.g. gs://bucket, s3://bucket or file:///var/lib/downloader. Overrides -bucket.")
 	projectName := flag.String("project", "", "Specify the project name to send the pub/sub in.")
-	maxmindLicenseKey := flag.String("maxmind_license_key", "", "the license key for maxmind downloading.")
-	maxmindAccountID := flag.String("maxmind_account_id", "", "the account ID for maxmind downloading.")
+	topicName := flag.String("topic", "downloader-new-files", "Specify the pub/sub topic to announce new files on.")
+	// The MaxMind credentials are referred to as flag:maxmind_license_key
+	// and flag:maxmind_account_id by the default config.
+	flag.String("maxmind_license_key", "", "the license key for maxmind downloading.")
+	flag.String("maxmind_account_id", "", "the account ID for maxmind downloading.")
+	once := flag.Bool("once", false, "Run every dataset once, print a JSON summary and exit, instead of running forever. Exits with status 1 if any dataset failed.")
+	dryRun := flag.Bool("dry_run", false, "Show what every dataset would download, and what the files would be named, as JSON, without writing anything to the store, and exit. Files are still downloaded in full.")
+	shutdownGrace := flag.Duration("shutdown_grace", 20*time.Second, "How long the downloads in flight at SIGTERM or SIGINT may take to finish before they are aborted.")
+	adminAddress := flag.String("admin_address", ":9991", "The address of the admin API, which reports the status of every dataset and runs datasets on demand.")
+	adminToken := flag.String("admin_token", "", "The bearer token needed to run datasets through the admin API. Datasets can't be run on demand without it.")
+	livenessBound := flag.Duration("liveness_bound", time.Hour, "How long a run of a dataset may go without progress, such as finishing a download attempt, before /healthz fails.")
+	configFile := flag.String("config", "", "Specify a YAML or JSON file describing the datasets to download. Defaults to the built-in MaxMind and Routeviews datasets.")
 
 	flag.Parse()
 	flagx.ArgsFromEnv(flag.CommandLine)
+	ctx, stop := signal.NotifyContext(mainCtx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	if *bucketName == "" {
-		log.Fatal("NO BUCKET SPECIFIED!!!")
+	if *bucketName == "" && *storeURL == "" {
+		log.Fatal("NO BUCKET OR STORE SPECIFIED!!!")
+	}
+	if *storeURL == "" {
+		*storeURL = "gs://" + *bucketName
+	}
+	// The store is constructed once, and shared by every run.
+	store, storeCloser, err := constructStore(*storeURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer storeCloser.Close()
+	cfg := conf.Default()
+	if *configFile != "" {
+		if cfg, err = conf.Load(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(ctx, store, cfg, flag.Args(), os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *dryRun {
+		status := runDryRun(ctx, store, cfg, os.Stdout)
+		mainCancel()
+		os.Exit(status)
 	}
 	if *projectName == "" {
 		log.Fatal("NO PROJECT SPECIFIED!!!")
 	}
+	pubsubNotifier, err := constructPubSubNotifier(*projectName, *topicName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pubsubNotifier.Stop()
+	notifier := notify.Multi{pubsubNotifier}
+	var webhooks []*notify.Webhook
+	for _, hook := range cfg.Webhooks {
+		w := notify.NewWebhook(hook, store)
+		webhooks = append(webhooks, w)
+		notifier = append(notifier, w)
+	}
+	schedules, err := registerSources(cfg, notifier)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *once {
+		// os.Exit skips deferred calls, so flush and cancel explicitly.
+		flush := func() {
+			pubsubNotifier.Stop()
+			for _, w := range webhooks {
+				w.Wait(context.Background())
+			}
+		}
+		status := runOnce(ctx, store, webhooks, flush, os.Stdout)
+		storeCloser.Close()
+		mainCancel()
+		os.Exit(status)
+	}
+	sched, err := newScheduler(store, schedules, webhooks, *shutdownGrace)
+	if err != nil {
+		log.Fatal(err)
+	}
 	prometheusx.MustServeMetrics()
-	loopOverURLsForever(mainCtx, *bucketName, *maxmindLicenseKey, *maxmindAccountID)
+	if *adminToken == "" {
+		log.Println("No -admin_token, so datasets can't be run on demand")
+	}
+	mustServeAdmin(ctx, *adminAddress, admin.NewHandler(sched, *adminToken, *livenessBound, storeReady(store)))
+	sched.Run(ctx)
+	// Webhooks still being sent get the grace too. Any that don't make it
+	// stay in the outbox for the next start.
+	graceCtx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	defer cancel()
+	for _, w := range webhooks {
+		if err := w.Wait(graceCtx); err != nil {
+			log.Println("Left undelivered webhooks in the outbox:", err)
+			break
+		}
+	}
+	log.Println("Shut down cleanly")
 }
 
-// loopOverURLsForever takes a bucketName, pointing to a GCS bucket,
-// and then tries to download the files over and over again until the
-// end of time (waiting an average of 8 hours in between attempts)
-func loopOverURLsForever(ctx context.Context, bucketName string, maxmindLicenseKey string, maxmindAccountID string) {
-	// TODO: consider migrating to github.com/m-lab/go/memoryless
-	lastDownloadedV4 := 0
-	lastDownloadedV6 := 0
-	for ctx.Err() == nil {
-		timestamp := time.Now().Format("2006/01/02/")
-		bkt, err := constructBucketHandle(bucketName)
+// registerSources registers a download.Source for every dataset in cfg,
+// each telling n about its new files, and returns the schedule of each,
+// by source name.
+func registerSources(cfg *conf.Config, n notify.Notifier) (map[string]conf.Schedule, error) {
+	schedules := map[string]conf.Schedule{}
+	for _, ds := range cfg.Datasets {
+		src, err := download.NewSource(ds, n)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		fileStore := file.NewGCSStore(bkt)
+		download.Register(src)
+		schedules[src.Name()] = ds.Schedule
+	}
+	return schedules, nil
+}
+
+// newScheduler returns a scheduler that, once run, tries to download the
+// files of every registered download.Source into store over and over
+// again until its context is done. Each source is a job of its own, run
+// independently on its own schedule or when triggered through the admin
+// API, and the runs in flight when the context is done are given grace to
+// finish. Webhooks that could not be delivered are retried whenever a
+// source is run.
+func newScheduler(store file.Store, schedules map[string]conf.Schedule, webhooks []*notify.Webhook, grace time.Duration) (*scheduler.Scheduler, error) {
+	sched := &scheduler.Scheduler{Grace: grace}
+	sources := download.Sources()
+	var mu sync.Mutex
+	succeeded := map[string]bool{}
+	for _, src := range sources {
+		timing, err := scheduler.NewTiming(schedules[src.Name()])
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %v", src.Name(), err)
+		}
+		src := src
+		sched.Add(src.Name(), timing, func(ctx context.Context) error {
+			results := runSources(ctx, store, []download.Source{src}, webhooks)
+			mu.Lock()
+			defer mu.Unlock()
+			succeeded[src.Name()] = results[0].Succeeded
+			allSucceeded := true
+			for _, s := range sources {
+				allSucceeded = allSucceeded && succeeded[s.Name()]
+			}
+			if allSucceeded {
+				metrics.LastSuccessTime.SetToCurrentTime()
+			}
+			if !results[0].Succeeded {
+				return errors.New(results[0].Error)
+			}
+			return nil
+		})
+	}
+	return sched, nil
+}
 
-		maxmindErr := download.MaxmindFiles(ctx, timestamp, fileStore, maxmindLicenseKey, maxmindAccountID)
-		if maxmindErr != nil {
-			log.Println(maxmindErr)
+// mustServeAdmin serves h on addr in the background until ctx is done,
+// and exits if it can't.
+func mustServeAdmin(ctx context.Context, addr string, h http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: h}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatal(err)
 		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+}
+
+// runResult is the outcome of running a source once.
+type runResult struct {
+	Source          string    `json:"source"`
+	Succeeded       bool      `json:"succeeded"`
+	Error           string    `json:"error,omitempty"`
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// runSources runs each of sources once against store, after retrying
+// the webhooks that could not be delivered before.
+func runSources(ctx context.Context, store file.Store, sources []download.Source, webhooks []*notify.Webhook) []runResult {
+	for _, w := range webhooks {
+		if err := w.Redeliver(ctx); err != nil {
+			log.Println("Webhook redelivery:", err)
+		}
+	}
+
+	var results []runResult
+	for _, src := range sources {
+		r := runResult{Source: src.Name(), Start: time.Now().UTC()}
+		err := download.Run(ctx, src, store)
+		if err != nil {
+			log.Println(src.Name()+":", err)
+			r.Error = err.Error()
+		}
+		r.Succeeded = err == nil
+		r.DurationSeconds = time.Since(r.Start).Seconds()
+		results = append(results, r)
+	}
+	return results
+}
+
+// onceSummary is printed by -once when it is done.
+type onceSummary struct {
+	Succeeded bool        `json:"succeeded"`
+	Sources   []runResult `json:"sources"`
+}
+
+// runOnce runs every registered download.Source a single time against
+// store, with the same code as the scheduler, and then calls flush to wait for the
+// notifications to be sent. It writes a JSON summary to w and returns
+// the exit status of the process, which is 1 if any source failed.
+func runOnce(ctx context.Context, store file.Store, webhooks []*notify.Webhook, flush func(), w io.Writer) int {
+	results := runSources(ctx, store, download.Sources(), webhooks)
+	flush()
 
-		routeviewIPv4Err := download.CaidaRouteviewsFiles(
-			ctx,
-			"http://data.caida.org/datasets/routing/routeviews-prefix2as/pfx2as-creation.log",
-			"RouteViewIPv4/",
-			&lastDownloadedV4,
-			"RouteViewIPv4/current/routeview.pfx2as.gz",
-			fileStore)
-		if routeviewIPv4Err != nil {
-			log.Println(routeviewIPv4Err)
+	summary := onceSummary{Succeeded: true, Sources: results}
+	for _, r := range results {
+		summary.Succeeded = summary.Succeeded && r.Succeeded
+	}
+	if summary.Succeeded {
+		metrics.LastSuccessTime.SetToCurrentTime()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if !summary.Succeeded {
+		return 1
+	}
+	return 0
+}
+
+// dryRunSummary is printed by -dry_run.
+type dryRunSummary struct {
+	Succeeded bool                   `json:"succeeded"`
+	Files     []download.PlannedFile `json:"files"`
+}
+
+// runDryRun reports what running every dataset of cfg once would do to
+// store, without writing anything to it. It writes a JSON summary to w
+// and returns the exit status of the process, which is 1 if any file
+// could not be planned.
+func runDryRun(ctx context.Context, store file.Store, cfg *conf.Config, w io.Writer) int {
+	summary := dryRunSummary{Succeeded: true}
+	for _, ds := range cfg.Datasets {
+		var planned []download.PlannedFile
+		src, err := download.NewSource(ds, nil)
+		if err == nil {
+			planned, err = download.Plan(ctx, src, store)
+		}
+		if err != nil {
+			log.Println(ds.Name+":", err)
+			summary.Succeeded = false
+			if len(planned) == 0 {
+				// Nothing was discovered, so say why.
+				planned = []download.PlannedFile{{Dataset: ds.Name, Outcome: download.PlannedFailed, Error: err.Error()}}
+			}
 		}
+		summary.Files = append(summary.Files, planned...)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if !summary.Succeeded {
+		return 1
+	}
+	return 0
+}
 
-		routeviewIPv6Err := download.CaidaRouteviewsFiles(
-			ctx,
-			"http://data.caida.org/datasets/routing/routeviews6-prefix2as/pfx2as-creation.log",
-			"RouteViewIPv6/",
-			&lastDownloadedV6,
-			"RouteViewIPv6/current/routeview.pfx2as.gz",
-			fileStore)
-		if routeviewIPv6Err != nil {
-			log.Println(routeviewIPv6Err)
+// storeReady returns a readiness check of store, which lists the state
+// the downloader keeps in it, so that it fails while the store can't be
+// reached or the credentials are not accepted.
+func storeReady(store file.Store) func() error {
+	return func() error {
+		ctx, cancel := context.WithTimeout(mainCtx, 10*time.Second)
+		defer cancel()
+		if _, err := store.List(ctx, "state/").Next(); err != nil && err != file.Done {
+			return err
 		}
+		return nil
+	}
+}
 
-		if maxmindErr == nil && routeviewIPv4Err == nil && routeviewIPv6Err == nil {
-			metrics.LastSuccessTime.SetToCurrentTime()
+// constructStore takes a store URL and returns the file.Store it
+// refers to. gs://bucket selects a GCS bucket and file:///some/dir
+// selects a directory on local disk. s3://bucket selects a bucket in
+// the S3-compatible service given by -s3_endpoint. It also returns what
+// to close once the store is no longer needed.
+func constructStore(storeURL string) (file.Store, io.Closer, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch u.Scheme {
+	case "gs":
+		if u.Host == "" {
+			return nil, nil, errors.New("store URL " + storeURL + " has no bucket name")
+		}
+		bkt, client, err := constructBucketHandle(u.Host)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file.NewGCSStore(bkt), client, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, nil, errors.New("store URL " + storeURL + " has no bucket name")
+		}
+		client, err := constructS3Client()
+		if err != nil {
+			return nil, nil, err
 		}
-		time.Sleep(download.GenUniformSleepTime(averageHoursBetweenUpdateChecks, windowForRandomTimeBetweenUpdateChecks))
+		store, err := file.NewS3Store(client, u.Host)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, nopCloser{}, nil
+	case "file":
+		if u.Path == "" {
+			return nil, nil, errors.New("store URL " + storeURL + " has no directory")
+		}
+		return file.NewLocalStore(u.Path), nopCloser{}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported store URL scheme %q in %s", u.Scheme, storeURL)
 	}
 }
 
+// nopCloser is the closer of stores that hold nothing to release.
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// constructPubSubNotifier returns a notifier that publishes to the
+// topic topicName in projectName. The topic must already exist. Set
+// PUBSUB_EMULATOR_HOST to publish to the local Pub/Sub emulator instead.
+func constructPubSubNotifier(projectName string, topicName string) (*notify.PubSub, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	client, err := pubsub.NewClient(mainCtx, projectName)
+	if err != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Client Setup"}).Inc()
+		return nil, err
+	}
+	topic := client.Topic(topicName)
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Client Setup"}).Inc()
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("pub/sub topic " + topicName + " does not exist in project " + projectName)
+	}
+	return notify.NewPubSub(topic), nil
+}
+
 // constructBucketHandle takes a bucket name and safely loads it,
-// returning either the handle to the bucket or an error
-func constructBucketHandle(bucketName string) (*storage.BucketHandle, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Minute)
-	client, err := storage.NewClient(ctx)
+// returning either the handle to the bucket and the client to close
+// once it is no longer needed, or an error
+func constructBucketHandle(bucketName string) (*storage.BucketHandle, *storage.Client, error) {
+	// The client is kept for as long as the downloader runs, so it must
+	// not be tied to a timeout.
+	client, err := storage.NewClient(mainCtx)
+	if err != nil {
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Client Setup"}).Inc()
+		return nil, nil, err
+	}
+	return client.Bucket(bucketName), client, nil
+}
+
+// constructS3Client builds an S3 client from the standard AWS
+// environment variables and shared config, pointed at -s3_endpoint if
+// it is set.
+func constructS3Client() (*s3.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
 	if err != nil {
 		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Client Setup"}).Inc()
 		return nil, err
 	}
-	return client.Bucket(bucketName), nil
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if *s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(*s3Endpoint)
+			// S3-compatible services rarely support virtual-hosted buckets.
+			o.UsePathStyle = true
+		}
+	}), nil
 }
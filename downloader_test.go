@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	conf "github.com/m-lab/downloader/config"
+	"github.com/m-lab/downloader/download"
+	"github.com/m-lab/downloader/file"
+)
+
+// fakeSource has a single candidate, which it fails to fetch if err is set.
+type fakeSource struct {
+	name string
+	err  error
+}
+
+func (f *fakeSource) Name() string        { return f.name }
+func (f *fakeSource) MetricLabel() string { return f.name }
+
+func (f *fakeSource) Discover(context.Context, file.Store) ([]download.Candidate, error) {
+	return []download.Candidate{{URL: "http://example.com/" + f.name}}, nil
+}
+
+func (f *fakeSource) Fetch(context.Context, file.Store, download.Candidate) error {
+	return f.err
+}
+
+func TestRunOnce(t *testing.T) {
+	download.Register(&fakeSource{name: "good"})
+	download.Register(&fakeSource{name: "bad", err: errors.New("Example Fetch Error")})
+
+	flushed := false
+	out := &bytes.Buffer{}
+	status := runOnce(context.Background(), file.NewLocalStore(t.TempDir()), nil, func() { flushed = true }, out)
+	if status != 1 {
+		t.Errorf("runOnce() returned %d, expected 1", status)
+	}
+	if !flushed {
+		t.Error("runOnce() did not flush the notifications")
+	}
+	var summary onceSummary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("runOnce() printed %q: %v", out, err)
+	}
+	if summary.Succeeded || len(summary.Sources) != 2 ||
+		!summary.Sources[0].Succeeded || summary.Sources[1].Error != "Example Fetch Error" {
+		t.Errorf("runOnce() printed %+v", summary)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "3363	1497717708	2017/06/routeviews-rv2-20170616-1200.pfx2as.gz\n")
+	}))
+	defer ts.Close()
+	cfg := &conf.Config{Datasets: []conf.Dataset{
+		{Name: "routeviews-v4", Kind: conf.KindRouteviews, Log: ts.URL + "/pfx2as-creation.log", PathPrefix: "RouteViewIPv4/"},
+		{Name: "broken", Kind: conf.KindRouteviews, Log: "ftp://nowhere/pfx2as-creation.log"},
+	}}
+	dir := t.TempDir()
+
+	out := &bytes.Buffer{}
+	if status := runDryRun(context.Background(), file.NewLocalStore(dir), cfg, out); status != 1 {
+		t.Errorf("runDryRun() returned %d, expected 1", status)
+	}
+	var summary dryRunSummary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("runDryRun() printed %q: %v", out, err)
+	}
+	if summary.Succeeded || len(summary.Files) != 2 ||
+		summary.Files[0].Outcome != download.PlannedNew ||
+		summary.Files[0].Object != "RouteViewIPv4/2017/06/routeviews-rv2-20170616-1200.pfx2as.gz" ||
+		summary.Files[1].Dataset != "broken" || summary.Files[1].Error == "" {
+		t.Errorf("runDryRun() printed %+v", summary)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("runDryRun() wrote %v to the store", entries)
+	}
+}
+
+func TestStoreReady(t *testing.T) {
+	dir := t.TempDir()
+	if err := storeReady(file.NewLocalStore(dir))(); err != nil {
+		t.Errorf("storeReady() returned %v for an empty store", err)
+	}
+	// A store whose root is a regular file can't be listed.
+	root := dir + "/not-a-dir"
+	if err := os.WriteFile(root, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeReady(file.NewLocalStore(root))(); err == nil {
+		t.Error("storeReady() returned nil for a store that can't be read")
+	}
+}
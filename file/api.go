@@ -1,10 +1,11 @@
 // Package file exports a generic file interface that we use to access Google
-// Cloud Storage. None of the functions here are unit-testable because they are
-// all either interfaces or connect to Google Cloud Storage, which cannot be
+// Cloud Storage or a directory on local disk. The GCS functions are not
+// unit-testable because they connect to Google Cloud Storage, which cannot be
 // unit tested.
 package file
 
 import (
+	"errors"
 	"flag"
 	"io"
 	"time"
@@ -12,8 +13,6 @@ import (
 	"golang.org/x/net/context"
 
 	"cloud.google.com/go/storage"
-	"github.com/m-lab/downloader/metrics"
-	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/api/iterator"
 )
 
@@ -21,19 +20,50 @@ var (
 	gcsCopyTimeout = flag.Duration("file.gcscopytimeout", 2*time.Minute, "Maximum time to wait for a file to copy on GCS")
 )
 
+var (
+	// Done is returned by ObjectIterator.Next when there are no more objects.
+	Done = iterator.Done
+	// ErrNotExist is returned by Object.GetReader when there is no such object.
+	ErrNotExist = errors.New("object does not exist")
+)
+
 // Store is the mockable interface to the functionality we need from CGS.
 type Store interface {
 	GetFile(name string) Object
-	NamesToMD5(ctx context.Context, prefix string) map[string][]byte
+	// List returns an iterator over the objects whose names start with prefix.
+	List(ctx context.Context, prefix string) ObjectIterator
+}
+
+// ObjectAttrs describes a single object returned by Store.List.
+type ObjectAttrs struct {
+	Name string
+	MD5  []byte // May be empty if the store does not know the MD5.
+	Size int64
+}
+
+// ObjectIterator streams the results of Store.List. Next returns Done once the
+// listing is complete. Any other error ends the listing and should be reported
+// to the caller, since the results seen so far are incomplete.
+type ObjectIterator interface {
+	Next() (*ObjectAttrs, error)
 }
 
 // Object is the mockable interface to the functionality we need from a single CGS object.
 type Object interface {
-	GetWriter(ctx context.Context) io.WriteCloser
+	GetReader(ctx context.Context) (io.ReadCloser, error)
+	GetWriter(ctx context.Context) Writer
 	DeleteFile(ctx context.Context) error
 	CopyTo(ctx context.Context, filename string) error
 }
 
+// Writer replaces the contents of an Object. Nothing written becomes visible
+// in the Store until Close returns successfully. Abort discards everything
+// written so far and leaves any previous contents of the Object in place.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
 // NewGCSStore adapts a bucket handle into a file.Store.
 func NewGCSStore(bkt *storage.BucketHandle) Store {
 	return &storeGCS{Bkt: bkt}
@@ -49,19 +79,22 @@ func (store *storeGCS) GetFile(name string) Object {
 	return &fileObjectGCS{bkt: store.Bkt, obj: store.Bkt.Object(name)}
 }
 
-func (store *storeGCS) NamesToMD5(ctx context.Context, prefix string) map[string][]byte {
-	objects := store.Bkt.Objects(ctx, &storage.Query{Prefix: ""})
-	namesAndMD5s := make(map[string][]byte)
-	for object, err := objects.Next(); err != iterator.Done; object, err = objects.Next() {
-		if err != nil {
-			metrics.DownloaderErrorCount.
-				With(prometheus.Labels{"source": "Unknown Error in iterator in checkIfHashIsUniqueInList"}).
-				Inc()
-		}
-		namesAndMD5s[object.Name] = object.MD5
-	}
-	return namesAndMD5s
+func (store *storeGCS) List(ctx context.Context, prefix string) ObjectIterator {
+	return &objectIteratorGCS{it: store.Bkt.Objects(ctx, &storage.Query{Prefix: prefix})}
+}
 
+// objectIteratorGCS adapts a storage.ObjectIterator, which fetches the
+// listing from GCS one page at a time, into a file.ObjectIterator.
+type objectIteratorGCS struct {
+	it *storage.ObjectIterator
+}
+
+func (it *objectIteratorGCS) Next() (*ObjectAttrs, error) {
+	object, err := it.it.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectAttrs{Name: object.Name, MD5: object.MD5, Size: object.Size}, nil
 }
 
 // GCS implementation of file.Object
@@ -70,8 +103,17 @@ type fileObjectGCS struct {
 	obj *storage.ObjectHandle
 }
 
-func (file *fileObjectGCS) GetWriter(ctx context.Context) io.WriteCloser {
-	return file.obj.NewWriter(ctx)
+func (file *fileObjectGCS) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	r, err := file.obj.NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotExist
+	}
+	return r, err
+}
+
+func (file *fileObjectGCS) GetWriter(ctx context.Context) Writer {
+	ctx, cancel := context.WithCancel(ctx)
+	return &writerGCS{Writer: file.obj.NewWriter(ctx), cancel: cancel}
 }
 
 func (file *fileObjectGCS) DeleteFile(ctx context.Context) error {
@@ -85,3 +127,21 @@ func (file *fileObjectGCS) CopyTo(ctx context.Context, filename string) error {
 	_, err := dst.CopierFrom(file.obj).Run(ctx)
 	return err
 }
+
+// writerGCS aborts uploads by canceling the context of the storage.Writer,
+// which GCS guarantees will leave no object behind.
+type writerGCS struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+func (w *writerGCS) Close() error {
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+func (w *writerGCS) Abort() error {
+	w.cancel()
+	w.Writer.Close()
+	return nil
+}
@@ -0,0 +1,32 @@
+package file
+
+import (
+	"encoding/json"
+
+	"golang.org/x/net/context"
+)
+
+// ReadJSON decodes the named object into v. It returns ErrNotExist if there
+// is no such object, which callers of small state objects usually treat as
+// "start from scratch".
+func ReadJSON(ctx context.Context, store Store, name string, v interface{}) error {
+	r, err := store.GetFile(name).GetReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+// WriteJSON replaces the named object with the JSON encoding of v. Readers see
+// either the old contents or the new ones, never a mix of the two.
+func WriteJSON(ctx context.Context, store Store, name string, v interface{}) error {
+	w := store.GetFile(name).GetWriter(ctx)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
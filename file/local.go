@@ -0,0 +1,270 @@
+package file
+
+import (
+	"crypto/md5"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// localTempPrefix marks files that are still being written or are about to be
+// removed. They are never reported as objects in the store.
+const localTempPrefix = ".downloader-tmp-"
+
+var errOutsideRoot = errors.New("object name escapes the store root")
+
+// NewLocalStore adapts a directory on local disk into a file.Store. Object
+// names are treated as slash-separated paths relative to root.
+func NewLocalStore(root string) Store {
+	return &storeLocal{root: root}
+}
+
+/// Local disk implementation of file.Store
+
+type storeLocal struct {
+	root string
+}
+
+// path returns the on-disk location of the named object, refusing names that
+// would resolve outside of the root directory.
+func (store *storeLocal) path(name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", errOutsideRoot
+	}
+	return filepath.Join(store.root, rel), nil
+}
+
+func (store *storeLocal) GetFile(name string) Object {
+	return &fileObjectLocal{store: store, name: name}
+}
+
+func (store *storeLocal) List(ctx context.Context, prefix string) ObjectIterator {
+	return &objectIteratorLocal{ctx: ctx, store: store, prefix: prefix}
+}
+
+// objectIteratorLocal walks the directory tree on the first call to Next, and
+// then hashes one file per call, so only the names are held in memory.
+type objectIteratorLocal struct {
+	ctx    context.Context
+	store  *storeLocal
+	prefix string
+	walked bool
+	names  []string
+}
+
+// walk collects the names of all objects that start with the prefix.
+func (it *objectIteratorLocal) walk() error {
+	// Only walk the deepest directory that can contain names with the prefix.
+	dir, err := it.store.path(path.Dir(it.prefix + "x"))
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := it.ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(it.store.root, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, it.prefix) {
+			it.names = append(it.names, name)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) && len(it.names) == 0 {
+		// Nothing has ever been written under the prefix.
+		return nil
+	}
+	return err
+}
+
+func (it *objectIteratorLocal) Next() (*ObjectAttrs, error) {
+	if !it.walked {
+		it.walked = true
+		if err := it.walk(); err != nil {
+			return nil, err
+		}
+	}
+	if len(it.names) == 0 {
+		return nil, Done
+	}
+	name := it.names[0]
+	it.names = it.names[1:]
+	p, _ := it.store.path(name)
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := md5File(p)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectAttrs{Name: name, MD5: sum, Size: info.Size()}, nil
+}
+
+// md5File returns the MD5 digest of the file at p.
+func md5File(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// createTemp makes a temporary file in the same directory as dst, so that it
+// can later be renamed over dst atomically. The rename keeps the mode of the
+// file, so unlike os.CreateTemp, which makes it 0600, it is made 0644 less
+// the umask, like os.Create would make dst.
+func createTemp(dst string) (*os.File, error) {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, localTempPrefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &fs.PathError{Op: "createtemp", Path: filepath.Join(dir, localTempPrefix+"*"), Err: fs.ErrExist}
+}
+
+// Local disk implementation of file.Object
+type fileObjectLocal struct {
+	store *storeLocal
+	name  string
+}
+
+func (file *fileObjectLocal) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	p, err := file.store.path(file.name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (file *fileObjectLocal) GetWriter(ctx context.Context) Writer {
+	dst, err := file.store.path(file.name)
+	if err != nil {
+		return &localWriter{err: err}
+	}
+	tmp, err := createTemp(dst)
+	if err != nil {
+		return &localWriter{err: err}
+	}
+	return &localWriter{tmp: tmp, dst: dst}
+}
+
+func (file *fileObjectLocal) DeleteFile(ctx context.Context) error {
+	p, err := file.store.path(file.name)
+	if err != nil {
+		return err
+	}
+	// Renaming first makes the object disappear in a single step, even if the
+	// removal of the underlying data is interrupted.
+	doomed := filepath.Join(filepath.Dir(p), localTempPrefix+filepath.Base(p))
+	if err := os.Rename(p, doomed); err != nil {
+		return err
+	}
+	return os.Remove(doomed)
+}
+
+func (file *fileObjectLocal) CopyTo(ctx context.Context, filename string) error {
+	src, err := file.store.path(file.name)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	dst, err := file.store.path(filename)
+	if err != nil {
+		return err
+	}
+	tmp, err := createTemp(dst)
+	if err != nil {
+		return err
+	}
+	w := &localWriter{tmp: tmp, dst: dst}
+	if _, err := io.Copy(w, in); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// localWriter writes to a temporary file and only renames it to its final
+// name on Close, so readers never observe a partially written object.
+type localWriter struct {
+	tmp *os.File
+	dst string
+	err error
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.tmp.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *localWriter) Close() error {
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	if err := w.tmp.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.tmp.Close(); err != nil {
+		os.Remove(w.tmp.Name())
+		return err
+	}
+	if err := os.Rename(w.tmp.Name(), w.dst); err != nil {
+		os.Remove(w.tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() error {
+	if w.tmp == nil {
+		return nil
+	}
+	w.tmp.Close()
+	return os.Remove(w.tmp.Name())
+}
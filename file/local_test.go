@@ -0,0 +1,184 @@
+package file
+
+import (
+	"context"
+	"crypto/md5"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeObject(t *testing.T, store Store, name string, contents string) {
+	w := store.GetFile(name).GetWriter(context.Background())
+	if _, err := io.WriteString(w, contents); err != nil {
+		t.Fatalf("Write(%q) returned %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(%q) returned %v", name, err)
+	}
+}
+
+// listMD5s drains store.List into a map of names to MD5s.
+func listMD5s(t *testing.T, store Store, prefix string) map[string][]byte {
+	got := map[string][]byte{}
+	it := store.List(context.Background(), prefix)
+	for {
+		attrs, err := it.Next()
+		if err == Done {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("List(%q) returned %v", prefix, err)
+		}
+		got[attrs.Name] = attrs.MD5
+	}
+}
+
+func md5Of(s string) []byte {
+	sum := md5.Sum([]byte(s))
+	return sum[:]
+}
+
+func TestLocalStoreWriteAndList(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStore(dir)
+	writeObject(t, store, "a/b/one", "one")
+	writeObject(t, store, "a/b/two", "two")
+	writeObject(t, store, "a/c/three", "three")
+
+	tests := []struct {
+		prefix string
+		want   map[string][]byte
+	}{
+		{"a/b/", map[string][]byte{"a/b/one": md5Of("one"), "a/b/two": md5Of("two")}},
+		{"a/b/o", map[string][]byte{"a/b/one": md5Of("one")}},
+		{"a/", map[string][]byte{"a/b/one": md5Of("one"), "a/b/two": md5Of("two"), "a/c/three": md5Of("three")}},
+		{"missing/", map[string][]byte{}},
+	}
+	for _, test := range tests {
+		got := listMD5s(t, store, test.prefix)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("List(%q) = %v, want %v", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestLocalStoreWriterIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStore(dir)
+	w := store.GetFile("x/obj").GetWriter(context.Background())
+	io.WriteString(w, "partial")
+	if _, err := os.Stat(filepath.Join(dir, "x", "obj")); !os.IsNotExist(err) {
+		t.Errorf("object visible before Close: %v", err)
+	}
+	if got := listMD5s(t, store, "x/"); len(got) != 0 {
+		t.Errorf("temporary file listed as an object: %v", got)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "x", "obj"))
+	if err != nil || string(b) != "partial" {
+		t.Errorf("ReadFile() = %q, %v", b, err)
+	}
+}
+
+func TestLocalStoreFileMode(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStore(dir)
+	writeObject(t, store, "obj", "contents")
+	if err := store.GetFile("obj").CopyTo(context.Background(), "copy"); err != nil {
+		t.Fatal(err)
+	}
+	// Objects get the mode os.Create gives, which respects the umask.
+	f, err := os.Create(filepath.Join(dir, "created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	want, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"obj", "copy"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || info.Mode().Perm() != want.Mode().Perm()&0644 {
+			t.Errorf("%s has mode %v, %v, expected %v", name, info.Mode().Perm(), err, want.Mode().Perm()&0644)
+		}
+	}
+}
+
+func TestLocalStoreListSize(t *testing.T) {
+	store := NewLocalStore(t.TempDir())
+	writeObject(t, store, "obj", "12345")
+	attrs, err := store.List(context.Background(), "obj").Next()
+	if err != nil || attrs.Size != 5 {
+		t.Errorf("Next() = %+v, %v", attrs, err)
+	}
+}
+
+func TestLocalStoreCopyAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocalStore(dir)
+	writeObject(t, store, "src/obj", "contents")
+	obj := store.GetFile("src/obj")
+	if err := obj.CopyTo(context.Background(), "current/obj"); err != nil {
+		t.Fatalf("CopyTo() returned %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "current", "obj"))
+	if err != nil || string(b) != "contents" {
+		t.Errorf("ReadFile() = %q, %v", b, err)
+	}
+	if err := obj.DeleteFile(context.Background()); err != nil {
+		t.Fatalf("DeleteFile() returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src", "obj")); !os.IsNotExist(err) {
+		t.Errorf("object still exists after DeleteFile: %v", err)
+	}
+	if err := obj.DeleteFile(context.Background()); err == nil {
+		t.Error("DeleteFile() of a missing object should fail")
+	}
+	if err := obj.CopyTo(context.Background(), "current/obj2"); err == nil {
+		t.Error("CopyTo() of a missing object should fail")
+	}
+}
+
+func TestLocalStoreRejectsEscapingNames(t *testing.T) {
+	store := NewLocalStore(t.TempDir())
+	w := store.GetFile("../outside").GetWriter(context.Background())
+	if _, err := io.WriteString(w, "x"); err == nil {
+		t.Error("Write() outside of the root should fail")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close() outside of the root should fail")
+	}
+	if err := store.GetFile("ok").CopyTo(context.Background(), "../../x"); err == nil {
+		t.Error("CopyTo() outside of the root should fail")
+	}
+}
+
+func TestLocalStoreReadAndAbort(t *testing.T) {
+	store := NewLocalStore(t.TempDir())
+	if _, err := store.GetFile("obj").GetReader(context.Background()); err != ErrNotExist {
+		t.Errorf("GetReader() of a missing object returned %v", err)
+	}
+	writeObject(t, store, "obj", "old")
+	w := store.GetFile("obj").GetWriter(context.Background())
+	io.WriteString(w, "new")
+	if err := w.Abort(); err != nil {
+		t.Errorf("Abort() returned %v", err)
+	}
+	r, err := store.GetFile("obj").GetReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, _ := io.ReadAll(r); string(b) != "old" {
+		t.Errorf("Abort() changed the object to %q", b)
+	}
+	if got := listMD5s(t, store, ""); len(got) != 1 {
+		t.Errorf("Abort() left files behind: %v", got)
+	}
+}
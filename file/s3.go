@@ -0,0 +1,301 @@
+package file
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3DigestPrefix holds an object for every multipart ETag the downloader
+// wrote, named after the ETag and holding the hex MD5 of the content. S3 only
+// uses the MD5 as the ETag for objects uploaded in a single part, and the MD5
+// of a multipart upload is only known once every part was sent, too late to
+// go into its metadata. Objects under the prefix are never listed.
+const s3DigestPrefix = ".downloader-digests/"
+
+// s3MinPartSize is the smallest part S3 accepts, except for the last one.
+const s3MinPartSize = 5 << 20
+
+var errS3Aborted = errors.New("upload was aborted")
+
+var (
+	s3CopyTimeout = flag.Duration("file.s3copytimeout", 2*time.Minute, "Maximum time to wait for a file to copy on S3")
+	s3PartSize    = flag.Int("file.s3partsize", 16<<20, "Size in bytes of each part of an S3 multipart upload. S3 requires at least 5MiB.")
+)
+
+// NewS3Store adapts a client for an S3-compatible service and a bucket name
+// into a file.Store. It fails if -file.s3partsize is too small for S3.
+func NewS3Store(client *s3.Client, bucket string) (Store, error) {
+	if *s3PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("-file.s3partsize is %d, S3 requires at least %d", *s3PartSize, s3MinPartSize)
+	}
+	return &storeS3{client: client, bucket: bucket}, nil
+}
+
+/// S3 implementation of file.Store
+
+type storeS3 struct {
+	client *s3.Client
+	bucket string
+}
+
+func (store *storeS3) GetFile(name string) Object {
+	return &fileObjectS3{store: store, key: name}
+}
+
+func (store *storeS3) List(ctx context.Context, prefix string) ObjectIterator {
+	return &objectIteratorS3{
+		ctx:   ctx,
+		store: store,
+		pages: s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(store.bucket),
+			Prefix: aws.String(prefix),
+		}),
+	}
+}
+
+// objectIteratorS3 fetches the listing one page at a time, so only a single
+// page of results is ever held in memory.
+type objectIteratorS3 struct {
+	ctx     context.Context
+	store   *storeS3
+	pages   *s3.ListObjectsV2Paginator
+	current []types.Object
+}
+
+func (it *objectIteratorS3) Next() (*ObjectAttrs, error) {
+	for {
+		for len(it.current) == 0 {
+			if !it.pages.HasMorePages() {
+				return nil, Done
+			}
+			page, err := it.pages.NextPage(it.ctx)
+			if err != nil {
+				return nil, err
+			}
+			it.current = page.Contents
+		}
+		object := it.current[0]
+		it.current = it.current[1:]
+		key := aws.ToString(object.Key)
+		if strings.HasPrefix(key, s3DigestPrefix) {
+			continue
+		}
+		sum, err := it.store.md5(it.ctx, aws.ToString(object.ETag))
+		if err != nil {
+			return nil, err
+		}
+		return &ObjectAttrs{Name: key, MD5: sum, Size: aws.ToInt64(object.Size)}, nil
+	}
+}
+
+// md5 returns the MD5 of an object, using its ETag when that is a plain MD5
+// and otherwise the digest recorded for the ETag when it was written.
+// Multipart objects written by something else have no such digest, so
+// their MD5 is unknown and left empty, as ObjectAttrs allows.
+func (store *storeS3) md5(ctx context.Context, etag string) ([]byte, error) {
+	etag = strings.Trim(etag, `"`)
+	if !strings.Contains(etag, "-") {
+		return hex.DecodeString(etag)
+	}
+	r, err := store.GetFile(s3DigestPrefix + etag).GetReader(ctx)
+	if err == ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	sum, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(string(sum))
+}
+
+// copySource returns the URL-encoded bucket/key form that CopyObject expects.
+func (store *storeS3) copySource(key string) string {
+	return (&url.URL{Path: store.bucket + "/" + key}).EscapedPath()
+}
+
+// S3 implementation of file.Object
+type fileObjectS3 struct {
+	store *storeS3
+	key   string
+}
+
+func (file *fileObjectS3) GetReader(ctx context.Context) (io.ReadCloser, error) {
+	out, err := file.store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(file.store.bucket),
+		Key:    aws.String(file.key),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (file *fileObjectS3) GetWriter(ctx context.Context) Writer {
+	return &s3Writer{ctx: ctx, store: file.store, key: file.key, md5: md5.New()}
+}
+
+func (file *fileObjectS3) DeleteFile(ctx context.Context) error {
+	_, err := file.store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(file.store.bucket),
+		Key:    aws.String(file.key),
+	})
+	return err
+}
+
+func (file *fileObjectS3) CopyTo(ctx context.Context, filename string) error {
+	ctx, cancel := context.WithTimeout(ctx, *s3CopyTimeout)
+	defer cancel()
+	_, err := file.store.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(file.store.bucket),
+		Key:        aws.String(filename),
+		CopySource: aws.String(file.store.copySource(file.key)),
+	})
+	return err
+}
+
+// s3Writer buffers data into parts. Objects smaller than one part are
+// uploaded with a single PutObject, larger ones with a multipart upload that
+// only becomes visible when it is completed in Close.
+type s3Writer struct {
+	ctx      context.Context
+	store    *storeS3
+	key      string
+	buf      bytes.Buffer
+	md5      hash.Hash
+	uploadID *string
+	parts    []types.CompletedPart
+	partMD5s []byte // The binary MD5 of every part, in order.
+	err      error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.md5.Write(p)
+	w.buf.Write(p)
+	for w.buf.Len() >= *s3PartSize {
+		if w.err = w.uploadPart(w.buf.Next(*s3PartSize)); w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+// uploadPart sends one part of a multipart upload, starting the upload if
+// this is the first part.
+func (w *s3Writer) uploadPart(data []byte) error {
+	client := w.store.client
+	if w.uploadID == nil {
+		out, err := client.CreateMultipartUpload(w.ctx, &s3.CreateMultipartUploadInput{
+			Bucket: aws.String(w.store.bucket),
+			Key:    aws.String(w.key),
+		})
+		if err != nil {
+			return err
+		}
+		w.uploadID = out.UploadId
+	}
+	partNumber := int32(len(w.parts) + 1)
+	out, err := client.UploadPart(w.ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(w.store.bucket),
+		Key:        aws.String(w.key),
+		UploadId:   w.uploadID,
+		PartNumber: aws.Int32(partNumber),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(partNumber)})
+	sum := md5.Sum(data)
+	w.partMD5s = append(w.partMD5s, sum[:]...)
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	client := w.store.client
+	if w.uploadID == nil {
+		_, w.err = client.PutObject(w.ctx, &s3.PutObjectInput{
+			Bucket: aws.String(w.store.bucket),
+			Key:    aws.String(w.key),
+			Body:   bytes.NewReader(w.buf.Bytes()),
+		})
+		return w.err
+	}
+	if w.buf.Len() > 0 {
+		if w.err = w.uploadPart(w.buf.Bytes()); w.err != nil {
+			w.Abort()
+			return w.err
+		}
+	}
+	// The ETag of a multipart object is not its MD5, so record the MD5
+	// under the ETag it will have before the object becomes visible. A
+	// digest left behind by a failed upload is still correct, and harmless.
+	etag := fmt.Sprintf("%x-%d", md5.Sum(w.partMD5s), len(w.parts))
+	_, w.err = client.PutObject(w.ctx, &s3.PutObjectInput{
+		Bucket: aws.String(w.store.bucket),
+		Key:    aws.String(s3DigestPrefix + etag),
+		Body:   strings.NewReader(hex.EncodeToString(w.md5.Sum(nil))),
+	})
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	_, w.err = client.CompleteMultipartUpload(w.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.store.bucket),
+		Key:             aws.String(w.key),
+		UploadId:        w.uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: w.parts},
+	})
+	if w.err != nil {
+		w.Abort()
+	}
+	return w.err
+}
+
+// Abort discards the buffered data and releases the parts of an unfinished
+// multipart upload.
+func (w *s3Writer) Abort() error {
+	w.buf.Reset()
+	if w.err == nil {
+		w.err = errS3Aborted
+	}
+	if w.uploadID == nil {
+		return nil
+	}
+	_, err := w.store.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.store.bucket),
+		Key:      aws.String(w.key),
+		UploadId: w.uploadID,
+	})
+	w.uploadID = nil
+	return err
+}
@@ -0,0 +1,376 @@
+package file
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+//// fakeS3 is a small in-process stand-in for an S3-compatible service. It
+//// implements just enough of the path-style REST API for storeS3.
+
+type fakeS3Object struct {
+	data     []byte
+	etag     string
+	metadata map[string]string
+}
+
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]*fakeS3Object  // keyed by bucket/key
+	uploads  map[string]map[int][]byte // keyed by upload ID
+	nextID   int
+	pageSize int
+	aborted  int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]*fakeS3Object{}, uploads: map[string]map[int][]byte{}, pageSize: 2}
+}
+
+func metadataFromHeader(h http.Header) map[string]string {
+	m := map[string]string{}
+	for k, v := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			m[strings.ToLower(strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-"))] = v[0]
+		}
+	}
+	return m
+}
+
+func md5ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && q.Get("list-type") == "2":
+		f.list(w, bucket, q)
+	case r.Method == http.MethodHead:
+		obj, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.metadata {
+			w.Header().Set("x-amz-meta-"+k, v)
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprint("upload-", f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, bucket, key, id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", md5ETag(body))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		// Like S3, the ETag is the MD5 of the MD5s of the parts.
+		var data, sums []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+			sum := md5.Sum(parts[n])
+			sums = append(sums, sum[:]...)
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		etag := fmt.Sprintf(`"%x-%d"`, md5.Sum(sums), len(numbers))
+		f.objects[path] = &fakeS3Object{data: data, etag: etag, metadata: map[string]string{}}
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, bucket, key, etag)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+		obj, ok := f.objects[strings.TrimPrefix(src, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		metadata := obj.metadata
+		if r.Header.Get("x-amz-metadata-directive") == "REPLACE" {
+			metadata = metadataFromHeader(r.Header)
+		}
+		f.objects[path] = &fakeS3Object{data: obj.data, etag: obj.etag, metadata: metadata}
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, obj.etag)
+	case r.Method == http.MethodPut:
+		f.objects[path] = &fakeS3Object{data: body, etag: md5ETag(body), metadata: metadataFromHeader(r.Header)}
+		w.Header().Set("ETag", md5ETag(body))
+	case r.Method == http.MethodGet:
+		obj, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Write(obj.data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// list returns one page of a ListObjectsV2 call.
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, q url.Values) {
+	type content struct {
+		Key  string
+		ETag string
+		Size int
+	}
+	type result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}
+	var keys []string
+	for path := range f.objects {
+		if key := strings.TrimPrefix(path, bucket+"/"); key != path && strings.HasPrefix(key, q.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start := 0
+	if token := q.Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	res := result{Name: bucket, Prefix: q.Get("prefix")}
+	for i := start; i < len(keys) && i < start+f.pageSize; i++ {
+		obj := f.objects[bucket+"/"+keys[i]]
+		res.Contents = append(res.Contents, content{Key: keys[i], ETag: obj.etag, Size: len(obj.data)})
+	}
+	if start+f.pageSize < len(keys) {
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(start + f.pageSize)
+	}
+	xml.NewEncoder(w).Encode(res)
+}
+
+func newTestS3Store(t *testing.T) (*fakeS3, Store) {
+	fake := newFakeS3()
+	ts := httptest.NewServer(fake)
+	t.Cleanup(ts.Close)
+	client := s3.New(s3.Options{
+		BaseEndpoint: aws.String(ts.URL),
+		Region:       "us-east-1",
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	})
+	// The store is made directly, so that tests can use tiny parts.
+	return fake, &storeS3{client: client, bucket: "bucket"}
+}
+
+//// End of the fake S3 service
+
+func TestS3StoreSinglePartUpload(t *testing.T) {
+	fake, store := newTestS3Store(t)
+	writeObject(t, store, "Maxmind/2020/01/02/a", "small")
+	obj, ok := fake.objects["bucket/Maxmind/2020/01/02/a"]
+	if !ok || string(obj.data) != "small" {
+		t.Fatalf("object not stored: %+v", obj)
+	}
+	if obj.etag != md5ETag([]byte("small")) {
+		t.Errorf("single part upload has ETag %s", obj.etag)
+	}
+}
+
+func TestS3StoreMultipartUpload(t *testing.T) {
+	old := *s3PartSize
+	*s3PartSize = 4
+	defer func() { *s3PartSize = old }()
+
+	fake, store := newTestS3Store(t)
+	writeObject(t, store, "big", "0123456789")
+	obj, ok := fake.objects["bucket/big"]
+	if !ok || string(obj.data) != "0123456789" {
+		t.Fatalf("object not stored: %+v", obj)
+	}
+	if !strings.HasSuffix(obj.etag, `-3"`) {
+		t.Errorf("expected a three part upload, got ETag %s", obj.etag)
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("multipart uploads left open: %v", fake.uploads)
+	}
+	// The MD5 must still be discoverable even though the ETag is not an MD5,
+	// also for copies, without listing where it is kept.
+	if err := store.GetFile("big").CopyTo(context.Background(), "copy"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"big": md5Of("0123456789"), "copy": md5Of("0123456789")}
+	if got := listMD5s(t, store, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestNewS3StorePartSize(t *testing.T) {
+	old := *s3PartSize
+	defer func() { *s3PartSize = old }()
+	*s3PartSize = s3MinPartSize - 1
+	if _, err := NewS3Store(s3.New(s3.Options{}), "bucket"); err == nil {
+		t.Error("NewS3Store() accepted parts smaller than S3 allows")
+	}
+	*s3PartSize = s3MinPartSize
+	if _, err := NewS3Store(s3.New(s3.Options{}), "bucket"); err != nil {
+		t.Errorf("NewS3Store() returned %v", err)
+	}
+}
+
+func TestS3StoreListWithoutMD5Metadata(t *testing.T) {
+	fake, store := newTestS3Store(t)
+	writeObject(t, store, "a/mine", "mine")
+	// A multipart object uploaded by something other than the downloader.
+	fake.objects["bucket/a/theirs"] = &fakeS3Object{data: []byte("theirs"), etag: fmt.Sprintf(`"%x-2"`, md5Of("x"))}
+
+	want := map[string][]byte{"a/mine": md5Of("mine"), "a/theirs": nil}
+	if got := listMD5s(t, store, "a/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestS3StoreFailedUploadIsAborted(t *testing.T) {
+	old := *s3PartSize
+	*s3PartSize = 4
+	defer func() { *s3PartSize = old }()
+
+	fake, store := newTestS3Store(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := store.GetFile("big").GetWriter(ctx)
+	if _, err := io.WriteString(w, "01234"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := io.WriteString(w, "56789"); err == nil {
+		t.Fatal("Write() with a canceled context should fail")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close() after a failed write should fail")
+	}
+	if _, ok := fake.objects["bucket/big"]; ok {
+		t.Error("failed upload became visible")
+	}
+	if fake.aborted != 1 {
+		t.Errorf("expected 1 aborted upload, got %d", fake.aborted)
+	}
+}
+
+func TestS3StoreList(t *testing.T) {
+	_, store := newTestS3Store(t)
+	writeObject(t, store, "a/b/one", "one")
+	writeObject(t, store, "a/b/two", "two")
+	writeObject(t, store, "a/b/three", "three")
+	writeObject(t, store, "a/c/four", "four")
+
+	want := map[string][]byte{"a/b/one": md5Of("one"), "a/b/two": md5Of("two"), "a/b/three": md5Of("three")}
+	// The fake returns two objects per page, so this crosses a page boundary.
+	if got := listMD5s(t, store, "a/b/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestS3StoreListReturnsErrors(t *testing.T) {
+	_, store := newTestS3Store(t)
+	writeObject(t, store, "a", "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.List(ctx, "").Next(); err == nil || err == Done {
+		t.Errorf("Next() with a canceled context returned %v", err)
+	}
+}
+
+func TestS3StoreCopyAndDelete(t *testing.T) {
+	fake, store := newTestS3Store(t)
+	writeObject(t, store, "dir/with space+plus", "contents")
+	obj := store.GetFile("dir/with space+plus")
+	if err := obj.CopyTo(context.Background(), "current/obj"); err != nil {
+		t.Fatalf("CopyTo() returned %v", err)
+	}
+	if got := fake.objects["bucket/current/obj"]; got == nil || string(got.data) != "contents" {
+		t.Errorf("copy has wrong contents: %+v", got)
+	}
+	if err := obj.DeleteFile(context.Background()); err != nil {
+		t.Fatalf("DeleteFile() returned %v", err)
+	}
+	if _, ok := fake.objects["bucket/dir/with space+plus"]; ok {
+		t.Error("object still exists after DeleteFile")
+	}
+	if err := store.GetFile("missing").CopyTo(context.Background(), "x"); err == nil {
+		t.Error("CopyTo() of a missing object should fail")
+	}
+}
+
+func TestS3StoreReadAndAbort(t *testing.T) {
+	old := *s3PartSize
+	*s3PartSize = 4
+	defer func() { *s3PartSize = old }()
+
+	fake, store := newTestS3Store(t)
+	if _, err := store.GetFile("obj").GetReader(context.Background()); err != ErrNotExist {
+		t.Errorf("GetReader() of a missing object returned %v", err)
+	}
+	writeObject(t, store, "obj", "old")
+	w := store.GetFile("obj").GetWriter(context.Background())
+	io.WriteString(w, "0123456789")
+	if err := w.Abort(); err != nil {
+		t.Errorf("Abort() returned %v", err)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close() after Abort() should fail")
+	}
+	if fake.aborted != 1 || len(fake.uploads) != 0 {
+		t.Errorf("multipart upload was not aborted: %d, %v", fake.aborted, fake.uploads)
+	}
+	r, err := store.GetFile("obj").GetReader(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, _ := io.ReadAll(r); string(b) != "old" {
+		t.Errorf("Abort() changed the object to %q", b)
+	}
+}
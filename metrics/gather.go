@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Sample is a single series of a metric, as gathered from a registry.
+type Sample struct {
+	Labels map[string]string
+	// The value of a counter or gauge, or the sum of a histogram.
+	Value float64
+	// The number of observations of a histogram.
+	Count uint64
+}
+
+// Gather returns the series of the metric called name in the default
+// registry whose labels include labels. It lets tests check the metrics
+// that the code under test changed.
+func Gather(name string, labels prometheus.Labels) ([]Sample, error) {
+	return GatherFrom(prometheus.DefaultGatherer, name, labels)
+}
+
+// GatherFrom is Gather for the metrics of g.
+func GatherFrom(g prometheus.Gatherer, name string, labels prometheus.Labels) ([]Sample, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var samples []Sample
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if s, ok := sample(m, labels); ok {
+				samples = append(samples, s)
+			}
+		}
+	}
+	return samples, nil
+}
+
+// sample returns the Sample of m, if its labels include labels.
+func sample(m *dto.Metric, labels prometheus.Labels) (Sample, bool) {
+	s := Sample{Labels: map[string]string{}}
+	for _, l := range m.GetLabel() {
+		s.Labels[l.GetName()] = l.GetValue()
+	}
+	for k, v := range labels {
+		if s.Labels[k] != v {
+			return Sample{}, false
+		}
+	}
+	switch {
+	case m.Counter != nil:
+		s.Value = m.GetCounter().GetValue()
+	case m.Gauge != nil:
+		s.Value = m.GetGauge().GetValue()
+	case m.Histogram != nil:
+		s.Value = m.GetHistogram().GetSampleSum()
+		s.Count = m.GetHistogram().GetSampleCount()
+	case m.Untyped != nil:
+		s.Value = m.GetUntyped().GetValue()
+	}
+	return s, true
+}
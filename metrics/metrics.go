@@ -5,6 +5,9 @@
 package metrics
 
 import (
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -50,4 +53,182 @@ var (
 		Name: "downloader_downloader_routeviews_url_error_total",
 		Help: "The number of errors that occured with retrieving the Routeviews URL list.",
 	}, []string{"source"})
+
+	// Measures how much the newest version of a dataset differs from the
+	// one before it, in bytes, records and prefixes
+	// Provides metrics:
+	//    downloader_version_delta_percent
+	// Example usage:
+	//    VersionDeltaPercent.With(prometheus.Labels{"dataset": "routeviews-v4", "stat": "bytes"}).Set(-1.5)
+	VersionDeltaPercent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "downloader_version_delta_percent",
+		Help: "The change of a stat of the newest version of a dataset from the version before it, as a percentage.",
+	}, []string{"dataset", "stat"})
+
+	// The last time each dataset was checked for new files
+	// Provides metrics:
+	//    downloader_dataset_last_attempt_time_seconds
+	// Example usage:
+	//    DatasetLastAttemptTime.With(prometheus.Labels{"dataset": "routeviews-v4"}).SetToCurrentTime()
+	DatasetLastAttemptTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "downloader_dataset_last_attempt_time_seconds",
+		Help: "The time that a dataset was last checked for new files.",
+	}, []string{"dataset"})
+
+	// The last time each dataset was checked without errors
+	// Provides metrics:
+	//    downloader_dataset_last_success_time_seconds
+	// Example usage:
+	//    DatasetLastSuccessTime.With(prometheus.Labels{"dataset": "routeviews-v4"}).SetToCurrentTime()
+	DatasetLastSuccessTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "downloader_dataset_last_success_time_seconds",
+		Help: "The time that all the files of a dataset were last downloaded successfully.",
+	}, []string{"dataset"})
+
+	// The last time a new file of each dataset was kept
+	// Provides metrics:
+	//    downloader_dataset_last_new_file_time_seconds
+	// Example usage:
+	//    DatasetLastNewFileTime.With(prometheus.Labels{"dataset": "routeviews-v4"}).SetToCurrentTime()
+	DatasetLastNewFileTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "downloader_dataset_last_new_file_time_seconds",
+		Help: "The time that a new file of a dataset was last kept.",
+	}, []string{"dataset"})
+
+	// How long ago the newest data we hold of each dataset was published
+	// upstream, as of the scrape
+	// Provides metrics:
+	//    downloader_dataset_data_age_seconds
+	// Example usage:
+	//    DatasetDataAge.SetPublished("routeviews-v4", published)
+	DatasetDataAge = newDataAge()
+
+	// How long the server of each dataset took to send the headers of a file
+	// Provides metrics:
+	//    downloader_http_ttfb_seconds
+	// Example usage:
+	//    HTTPTimeToFirstByte.With(prometheus.Labels{"dataset": "routeviews-v4"}).Observe(0.5)
+	HTTPTimeToFirstByte = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downloader_http_ttfb_seconds",
+		Help:    "The time from sending the request for a file to receiving its response headers.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+	}, []string{"dataset"})
+
+	// How long it took to read the body of a file from its server
+	// Provides metrics:
+	//    downloader_transfer_duration_seconds
+	// Example usage:
+	//    TransferDuration.With(prometheus.Labels{"dataset": "routeviews-v4"}).Observe(12)
+	TransferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downloader_transfer_duration_seconds",
+		Help:    "The time spent reading the body of a file from its server, not counting the writes to the store.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 16),
+	}, []string{"dataset"})
+
+	// How big the files transferred are
+	// Provides metrics:
+	//    downloader_transfer_bytes
+	// Example usage:
+	//    TransferBytes.With(prometheus.Labels{"dataset": "routeviews-v4"}).Observe(1234)
+	TransferBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downloader_transfer_bytes",
+		Help:    "The size of the files transferred, in bytes.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+	}, []string{"dataset"})
+
+	// How fast the body of a file was read from its server
+	// Provides metrics:
+	//    downloader_transfer_throughput_bytes_per_second
+	// Example usage:
+	//    TransferThroughput.With(prometheus.Labels{"dataset": "routeviews-v4"}).Observe(1e6)
+	TransferThroughput = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downloader_transfer_throughput_bytes_per_second",
+		Help:    "The rate at which the body of a file was read from its server, in bytes per second.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+	}, []string{"dataset"})
+
+	// How long it took to write a new file to the store
+	// Provides metrics:
+	//    downloader_upload_duration_seconds
+	// Example usage:
+	//    UploadDuration.With(prometheus.Labels{"dataset": "routeviews-v4"}).Observe(2)
+	UploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downloader_upload_duration_seconds",
+		Help:    "The time spent writing a new file to the store while it was transferred, and committing it.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+	}, []string{"dataset"})
+
+	// How long it took to check whether a file is a duplicate
+	// Provides metrics:
+	//    downloader_dedup_check_duration_seconds
+	// Example usage:
+	//    DedupCheckDuration.With(prometheus.Labels{"dataset": "routeviews-v4"}).Observe(0.2)
+	DedupCheckDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downloader_dedup_check_duration_seconds",
+		Help:    "The time taken to check whether a file duplicates one already stored.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+	}, []string{"dataset"})
+
+	// How long it took to copy a new file to its current name
+	// Provides metrics:
+	//    downloader_copy_to_duration_seconds
+	// Example usage:
+	//    CopyToDuration.With(prometheus.Labels{"dataset": "routeviews-v4"}).Observe(1)
+	CopyToDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downloader_copy_to_duration_seconds",
+		Help:    "The time taken to copy a new file to the current name of its dataset.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+	}, []string{"dataset"})
+
+	// Counts what came of every attempt to download a file
+	// Provides metrics:
+	//    downloader_download_outcomes_total
+	// Example usage:
+	//    DownloadOutcomeCount.With(prometheus.Labels{"dataset": "routeviews-v4", "outcome": "new"}).Inc()
+	DownloadOutcomeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "downloader_download_outcomes_total",
+		Help: "The number of attempts to download a file, by whether the file was new, a duplicate, not modified, or the attempt failed.",
+	}, []string{"dataset", "outcome"})
 )
+
+// DataAge is a gauge of how old the data of each dataset is, which grows
+// between scrapes without being set.
+type DataAge struct {
+	desc      *prometheus.Desc
+	mu        sync.Mutex
+	published map[string]time.Time
+}
+
+// newDataAge returns a DataAge registered with the default registry.
+func newDataAge() *DataAge {
+	d := &DataAge{
+		desc: prometheus.NewDesc("downloader_dataset_data_age_seconds",
+			"How long ago the newest data held of a dataset was published upstream.",
+			[]string{"dataset"}, nil),
+		published: map[string]time.Time{},
+	}
+	prometheus.MustRegister(d)
+	return d
+}
+
+// SetPublished records when the newest data held of dataset was
+// published upstream.
+func (d *DataAge) SetPublished(dataset string, published time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.published[dataset] = published
+}
+
+// Describe implements prometheus.Collector.
+func (d *DataAge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.desc
+}
+
+// Collect implements prometheus.Collector.
+func (d *DataAge) Collect(ch chan<- prometheus.Metric) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for dataset, published := range d.published {
+		ch <- prometheus.MustNewConstMetric(d.desc, prometheus.GaugeValue, time.Since(published).Seconds(), dataset)
+	}
+}
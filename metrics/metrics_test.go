@@ -2,9 +2,11 @@ package metrics_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/m-lab/downloader/metrics"
 	"github.com/m-lab/go/prometheusx/promtest"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestMetrics(t *testing.T) {
@@ -12,5 +14,48 @@ func TestMetrics(t *testing.T) {
 	metrics.FailedDownloadCount.WithLabelValues("x")
 	metrics.DownloaderErrorCount.WithLabelValues("x")
 	metrics.RouteviewsURLErrorCount.WithLabelValues("x")
+	metrics.VersionDeltaPercent.WithLabelValues("x", "x")
+	metrics.DatasetLastAttemptTime.WithLabelValues("x")
+	metrics.DatasetLastSuccessTime.WithLabelValues("x")
+	metrics.DatasetLastNewFileTime.WithLabelValues("x")
+	metrics.DatasetDataAge.SetPublished("x", time.Now())
+	metrics.HTTPTimeToFirstByte.WithLabelValues("x")
+	metrics.TransferDuration.WithLabelValues("x")
+	metrics.TransferBytes.WithLabelValues("x")
+	metrics.TransferThroughput.WithLabelValues("x")
+	metrics.UploadDuration.WithLabelValues("x")
+	metrics.DedupCheckDuration.WithLabelValues("x")
+	metrics.CopyToDuration.WithLabelValues("x")
+	metrics.DownloadOutcomeCount.WithLabelValues("x", "x")
 	promtest.LintMetrics(t)
 }
+
+func TestGatherFrom(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "A test."}, []string{"dataset", "outcome"})
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_seconds", Help: "A test."}, []string{"dataset"})
+	reg.MustRegister(counter, histogram)
+	counter.WithLabelValues("a", "new").Add(2)
+	counter.WithLabelValues("a", "failed").Inc()
+	counter.WithLabelValues("b", "new").Inc()
+	histogram.WithLabelValues("a").Observe(1.5)
+	histogram.WithLabelValues("a").Observe(2)
+
+	samples, err := metrics.GatherFrom(reg, "test_total", prometheus.Labels{"dataset": "a", "outcome": "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].Value != 2 || samples[0].Labels["outcome"] != "new" {
+		t.Errorf("GatherFrom() returned %+v, expected the one counter of a and new", samples)
+	}
+	if samples, _ := metrics.GatherFrom(reg, "test_total", prometheus.Labels{"dataset": "a"}); len(samples) != 2 {
+		t.Errorf("GatherFrom() returned %+v, expected both counters of a", samples)
+	}
+	samples, _ = metrics.GatherFrom(reg, "test_seconds", nil)
+	if len(samples) != 1 || samples[0].Count != 2 || samples[0].Value != 3.5 {
+		t.Errorf("GatherFrom() returned %+v, expected 2 observations summing to 3.5", samples)
+	}
+	if samples, _ := metrics.GatherFrom(reg, "nope", nil); len(samples) != 0 {
+		t.Errorf("GatherFrom() returned %+v for a missing metric", samples)
+	}
+}
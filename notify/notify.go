@@ -0,0 +1,40 @@
+// Package notify tells other systems about the new files that the
+// downloader keeps, so that they can process them without polling the
+// store.
+package notify
+
+import (
+	"context"
+)
+
+// NewFile describes a file that the downloader has just kept, and copied
+// to its dataset's current name if the dataset has one.
+type NewFile struct {
+	Dataset string `json:"dataset"` // The name of the dataset in the config.
+	Object  string `json:"object"`  // The name of the object in the store.
+	Size    int64  `json:"size"`    // The size of the object in bytes.
+	MD5     string `json:"md5"`     // The MD5 of the object, in hex.
+	URL     string `json:"url"`     // The URL the object was downloaded from.
+}
+
+// Notifier is told about every new file.
+type Notifier interface {
+	// Notify returns once the notification has been delivered, or
+	// with the reason it could not be.
+	Notify(ctx context.Context, f NewFile) error
+}
+
+// Multi is a Notifier that notifies every Notifier in it, in order. It
+// returns the last error encountered, but does not stop at errors.
+type Multi []Notifier
+
+// Notify notifies every Notifier in m.
+func (m Multi) Notify(ctx context.Context, f NewFile) error {
+	var lastErr error
+	for _, n := range m {
+		if err := n.Notify(ctx, f); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
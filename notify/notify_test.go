@@ -0,0 +1,28 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeNotifier struct {
+	err   error
+	files []NewFile
+}
+
+func (f *fakeNotifier) Notify(_ context.Context, file NewFile) error {
+	f.files = append(f.files, file)
+	return f.err
+}
+
+func TestMulti(t *testing.T) {
+	a, b := &fakeNotifier{err: errors.New("Example Notify Error")}, &fakeNotifier{}
+	err := Multi{a, b}.Notify(context.Background(), NewFile{Object: "x"})
+	if err == nil {
+		t.Error("Multi.Notify() should return the error of a")
+	}
+	if len(a.files) != 1 || len(b.files) != 1 {
+		t.Errorf("Multi.Notify() should notify every Notifier, got %v and %v", a.files, b.files)
+	}
+}
@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PubSub publishes a message to a Pub/Sub topic for every new file. The
+// message data is the NewFile as JSON, and the dataset and object are
+// also attributes, so that subscriptions can filter on them.
+type PubSub struct {
+	topic *pubsub.Topic
+}
+
+// NewPubSub returns a Notifier that publishes to topic.
+func NewPubSub(topic *pubsub.Topic) *PubSub {
+	return &PubSub{topic: topic}
+}
+
+// Notify publishes f and waits for the server to accept it.
+func (p *PubSub) Notify(ctx context.Context, f NewFile) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	res := p.topic.Publish(ctx, &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"dataset": f.Dataset,
+			"object":  f.Object,
+		},
+	})
+	_, err = res.Get(ctx)
+	return err
+}
+
+// Stop sends any remaining messages and stops the goroutines publishing
+// them.
+func (p *PubSub) Stop() {
+	p.topic.Stop()
+}
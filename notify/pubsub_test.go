@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestPubSub(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := pubsub.NewClient(ctx, "test-project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic, err := client.CreateTopic(ctx, "downloader-new-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPubSub(topic)
+	defer p.Stop()
+	f := NewFile{
+		Dataset: "routeviews-v4",
+		Object:  "RouteViewIPv4/2017/05/routeviews-rv2-20170501-1200.pfx2as.gz",
+		Size:    1234,
+		MD5:     "d41d8cd98f00b204e9800998ecf8427e",
+		URL:     "http://example.com/2017/05/routeviews-rv2-20170501-1200.pfx2as.gz",
+	}
+	if err := p.Notify(ctx, f); err != nil {
+		t.Fatalf("Notify() returned %v", err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(msgs))
+	}
+	var got NewFile
+	if err := json.Unmarshal(msgs[0].Data, &got); err != nil || got != f {
+		t.Errorf("Published %s, expected %+v", msgs[0].Data, f)
+	}
+	want := map[string]string{"dataset": f.Dataset, "object": f.Object}
+	if !reflect.DeepEqual(msgs[0].Attributes, want) {
+		t.Errorf("Published attributes %v, expected %v", msgs[0].Attributes, want)
+	}
+}
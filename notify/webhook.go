@@ -0,0 +1,252 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/m-lab/downloader/config"
+	"github.com/m-lab/downloader/file"
+	"github.com/m-lab/downloader/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	webhookAttempts = flag.Int("notify.webhookattempts", 5, "How many times to try delivering a webhook before leaving it in the outbox for later")
+	webhookBackoff  = flag.Duration("notify.webhookbackoff", time.Second, "How long to wait after the first failed webhook delivery. The wait doubles after every failure")
+	webhookTimeout  = flag.Duration("notify.webhooktimeout", 30*time.Second, "The maximum amount of time a single webhook request may take")
+)
+
+// outboxPrefix is where undelivered webhooks are kept, next to the rest
+// of the downloader's state.
+const outboxPrefix = "state/outbox/"
+
+// SignatureHeader is the header holding the HMAC-SHA256 of the request
+// body, keyed with the webhook's secret, as "sha256=<hex>".
+const SignatureHeader = "X-Downloader-Signature-256"
+
+// DeliveryHeader is the header holding the unique ID of a delivery.
+// Deliveries are retried until they succeed, so a receiver may see the
+// same delivery more than once and can use the ID to ignore repeats.
+const DeliveryHeader = "X-Downloader-Delivery"
+
+// delivery is a webhook waiting in the outbox.
+type delivery struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Created time.Time `json:"created"`
+	File    NewFile   `json:"file"`
+}
+
+// Webhook POSTs every new file, as JSON, to an HTTP endpoint. Before a
+// delivery is attempted it is saved in an outbox in the store, and it is
+// only removed once the endpoint accepts it, so that notifications
+// survive failures of the endpoint and restarts of the downloader.
+// Deliveries happen in the background, so a slow or failing endpoint
+// never holds up the downloads.
+type Webhook struct {
+	hook   conf.Webhook
+	store  file.Store
+	client *http.Client
+	// Held while redelivering, so that sources running at the same time
+	// neither deliver the outbox twice nor wait for each other.
+	redeliverMu sync.Mutex
+	// The deliveries started by Notify that are still going on, by outbox
+	// name, so that Redeliver leaves them alone.
+	inFlight  sync.WaitGroup
+	sendingMu sync.Mutex
+	sending   map[string]bool
+}
+
+// NewWebhook returns a Notifier for hook, keeping its outbox in store.
+func NewWebhook(hook conf.Webhook, store file.Store) *Webhook {
+	return &Webhook{hook: hook, store: store, client: &http.Client{}, sending: map[string]bool{}}
+}
+
+// outboxDir returns the directory of the outbox of w.
+func (w *Webhook) outboxDir() string {
+	sum := sha256.Sum256([]byte(w.hook.URL))
+	return outboxPrefix + hex.EncodeToString(sum[:]) + "/"
+}
+
+// Notify saves f to the outbox and returns, leaving it to be delivered in
+// the background. If it can't be delivered, it stays in the outbox until
+// Redeliver succeeds.
+func (w *Webhook) Notify(ctx context.Context, f NewFile) error {
+	sum := sha256.Sum256([]byte(f.Object))
+	d := &delivery{
+		ID:      time.Now().UTC().Format("20060102T150405.000000000Z-") + hex.EncodeToString(sum[:8]),
+		URL:     w.hook.URL,
+		Created: time.Now().UTC(),
+		File:    f,
+	}
+	name := w.outboxDir() + d.ID + ".json"
+	if err := file.WriteJSON(ctx, w.store, name, d); err != nil {
+		// Deliver anyway, it just won't survive a restart.
+		log.Println("Couldn't save webhook to the outbox", name, err)
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Webhook Outbox Error"}).Inc()
+	}
+	// The delivery outlives ctx, which ends with the download of f. Each
+	// attempt is still bounded by -notify.webhooktimeout.
+	w.sendingMu.Lock()
+	w.sending[name] = true
+	w.sendingMu.Unlock()
+	w.inFlight.Add(1)
+	go func() {
+		defer w.inFlight.Done()
+		w.deliverAndRemove(context.Background(), name, d)
+		w.sendingMu.Lock()
+		delete(w.sending, name)
+		w.sendingMu.Unlock()
+	}()
+	return nil
+}
+
+// isSending reports whether the delivery saved as name is being sent by
+// Notify.
+func (w *Webhook) isSending(name string) bool {
+	w.sendingMu.Lock()
+	defer w.sendingMu.Unlock()
+	return w.sending[name]
+}
+
+// Wait waits for the deliveries started by Notify to succeed, or to give
+// up and leave their webhook in the outbox, or until ctx is done, in which
+// case it returns ctx.Err().
+func (w *Webhook) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		w.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Redeliver tries again to deliver every webhook left in the outbox, except
+// those Notify is still sending. It returns the last error encountered,
+// but does not stop at errors. If the outbox is already being redelivered,
+// it returns nil right away.
+func (w *Webhook) Redeliver(ctx context.Context) error {
+	if !w.redeliverMu.TryLock() {
+		return nil
+	}
+	defer w.redeliverMu.Unlock()
+	var names []string
+	objects := w.store.List(ctx, w.outboxDir())
+	for {
+		attrs, err := objects.Next()
+		if err == file.Done {
+			break
+		}
+		if err != nil {
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Webhook Outbox Error"}).Inc()
+			return err
+		}
+		if !w.isSending(attrs.Name) {
+			names = append(names, attrs.Name)
+		}
+	}
+
+	var lastErr error
+	for _, name := range names {
+		d := &delivery{}
+		if err := file.ReadJSON(ctx, w.store, name, d); err != nil {
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Webhook Outbox Error"}).Inc()
+			lastErr = err
+			continue
+		}
+		if err := w.deliverAndRemove(ctx, name, d); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// deliverAndRemove delivers d, retrying with backoff, and removes it from
+// the outbox once it is delivered.
+func (w *Webhook) deliverAndRemove(ctx context.Context, name string, d *delivery) error {
+	wait := *webhookBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = w.deliver(ctx, d); err == nil {
+			break
+		}
+		log.Printf("Webhook delivery %s to %s failed: %v\n", d.ID, d.URL, err)
+		if attempt >= *webhookAttempts {
+			metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Webhook Delivery Error"}).Inc()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	if err := w.store.GetFile(name).DeleteFile(ctx); err != nil {
+		// It will be delivered again, which receivers have to handle anyway.
+		metrics.DownloaderErrorCount.With(prometheus.Labels{"source": "Webhook Outbox Error"}).Inc()
+	}
+	return nil
+}
+
+// deliver makes a single attempt to POST d to the endpoint.
+func (w *Webhook) deliver(ctx context.Context, d *delivery) error {
+	secret, err := conf.ResolveSecret(w.hook.Secret)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(d.File)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, d.ID)
+	req.Header.Set(SignatureHeader, Sign(secret, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("URL:" + d.URL + " gave response code " + resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the value of SignatureHeader for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature, the value of SignatureHeader, is the
+// signature of body. Receivers written in Go can use it to check requests.
+func Verify(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
@@ -0,0 +1,151 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	conf "github.com/m-lab/downloader/config"
+	"github.com/m-lab/downloader/file"
+)
+
+// outboxSize returns the number of deliveries in the outbox of w.
+func outboxSize(t *testing.T, w *Webhook) int {
+	n := 0
+	objects := w.store.List(context.Background(), w.outboxDir())
+	for {
+		_, err := objects.Next()
+		if err == file.Done {
+			return n
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	defer func(b time.Duration) { *webhookBackoff = b }(*webhookBackoff)
+	*webhookBackoff = time.Millisecond
+	os.Setenv("WEBHOOK_TEST_SECRET", "s3cr3t")
+	defer os.Unsetenv("WEBHOOK_TEST_SECRET")
+
+	up := false
+	var received []NewFile
+	var deliveries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !Verify("s3cr3t", body, r.Header.Get(SignatureHeader)) {
+			t.Errorf("Bad signature %q", r.Header.Get(SignatureHeader))
+		}
+		var f NewFile
+		if err := json.Unmarshal(body, &f); err != nil {
+			t.Error(err)
+		}
+		received = append(received, f)
+		deliveries = append(deliveries, r.Header.Get(DeliveryHeader))
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	w := NewWebhook(conf.Webhook{URL: ts.URL, Secret: "env:WEBHOOK_TEST_SECRET"}, file.NewLocalStore(t.TempDir()))
+	f := NewFile{Dataset: "maxmind", Object: "Maxmind/2017/05/01/x.tar.gz", Size: 3, MD5: "abc", URL: "http://example.com"}
+
+	// While the endpoint is down, the delivery stays in the outbox.
+	if err := w.Notify(ctx, f); err != nil {
+		t.Errorf("Notify() returned %v", err)
+	}
+	w.Wait(context.Background())
+	if n := outboxSize(t, w); n != 1 {
+		t.Fatalf("Expected 1 delivery in the outbox, got %d", n)
+	}
+
+	// Once it is back, redelivery empties the outbox.
+	up = true
+	if err := w.Redeliver(ctx); err != nil {
+		t.Errorf("Redeliver() returned %v", err)
+	}
+	if n := outboxSize(t, w); n != 0 {
+		t.Errorf("Expected an empty outbox, got %d", n)
+	}
+	if err := w.Notify(ctx, f); err != nil {
+		t.Errorf("Notify() returned %v", err)
+	}
+	w.Wait(context.Background())
+	if n := outboxSize(t, w); n != 0 {
+		t.Errorf("Expected an empty outbox after delivery, got %d", n)
+	}
+	if len(received) != 2 || received[0] != f || received[1] != f {
+		t.Errorf("Received %+v", received)
+	}
+	if len(deliveries) != 2 || deliveries[0] == "" || deliveries[0] == deliveries[1] {
+		t.Errorf("Expected two distinct delivery IDs, got %q", deliveries)
+	}
+}
+
+func TestWebhookNotifyDoesNotWait(t *testing.T) {
+	release := make(chan struct{})
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+	}))
+	defer ts.Close()
+	w := NewWebhook(conf.Webhook{URL: ts.URL}, file.NewLocalStore(t.TempDir()))
+
+	done := make(chan error)
+	go func() { done <- w.Notify(context.Background(), NewFile{Object: "x"}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Notify() returned %v", err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("Notify() waited for the endpoint")
+	}
+	if n := outboxSize(t, w); n != 1 {
+		t.Errorf("Expected 1 delivery in the outbox, got %d", n)
+	}
+
+	// Redelivery leaves the delivery in flight alone.
+	if err := w.Redeliver(context.Background()); err != nil {
+		t.Errorf("Redeliver() returned %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := w.Wait(ctx); err == nil {
+		t.Error("Wait() returned nil with a delivery in flight")
+	}
+	close(release)
+	if err := w.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() returned %v", err)
+	}
+	if n := outboxSize(t, w); n != 0 {
+		t.Errorf("Expected an empty outbox once delivered, got %d", n)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("The endpoint got %d requests, expected 1", n)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"object": "x"}`)
+	sig := Sign("secret", body)
+	if !Verify("secret", body, sig) {
+		t.Error("Verify() rejected a valid signature")
+	}
+	if Verify("other", body, sig) || Verify("secret", []byte("{}"), sig) || Verify("secret", body, "") {
+		t.Error("Verify() accepted an invalid signature")
+	}
+}
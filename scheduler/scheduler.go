@@ -0,0 +1,503 @@
+// Package scheduler runs jobs over and over, each on its own schedule,
+// until it is told to stop. Every wait it does ends early when its context
+// is done, so that the downloader can shut down promptly.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m-lab/go/memoryless"
+	"github.com/robfig/cron"
+
+	conf "github.com/m-lab/downloader/config"
+)
+
+// Sleep waits for d, or until ctx is done, whichever comes first. It
+// returns ctx.Err() if ctx is done first.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	return waitFor(ctx, t)
+}
+
+// waitFor waits for t to fire, or until ctx is done.
+func waitFor(ctx context.Context, t *time.Timer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Timing decides when a job runs again.
+type Timing interface {
+	// Timer returns a timer that fires when the job is due to run again,
+	// after a run that ended at now, and when that is.
+	Timer(now time.Time) (*time.Timer, time.Time)
+}
+
+// timerAt returns a timer that fires at next, and next.
+func timerAt(next time.Time) (*time.Timer, time.Time) {
+	return time.NewTimer(time.Until(next)), next
+}
+
+// NewTiming returns the Timing of s.
+func NewTiming(s conf.Schedule) (Timing, error) {
+	var t Timing
+	switch s.Kind {
+	case conf.ScheduleMemoryless, "":
+		m := memorylessTiming{memoryless.Config{Expected: s.Interval, Min: s.Min, Max: s.Max}}
+		if err := m.config.Check(); err != nil {
+			return nil, err
+		}
+		t = m
+	case conf.ScheduleFixed:
+		if s.Interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %v", s.Interval)
+		}
+		t = fixedTiming{s.Interval}
+	case conf.ScheduleCron:
+		c, err := cron.ParseStandard(s.Cron)
+		if err != nil {
+			return nil, err
+		}
+		t = cronTiming{c}
+	default:
+		return nil, fmt.Errorf("unknown schedule kind %q", s.Kind)
+	}
+	if s.Jitter > 0 {
+		t = jitteredTiming{t, s.Jitter}
+	}
+	return t, nil
+}
+
+// memorylessTiming waits a memoryless, exponentially distributed interval.
+type memorylessTiming struct {
+	config memoryless.Config
+}
+
+// Timer draws the interval the way the memoryless package does, within
+// the bounds of the config, so that when the timer fires is known.
+func (m memorylessTiming) Timer(now time.Time) (*time.Timer, time.Time) {
+	wait := time.Duration(rand.ExpFloat64() * float64(m.config.Expected))
+	if wait < m.config.Min {
+		wait = m.config.Min
+	}
+	if m.config.Max != 0 && wait > m.config.Max {
+		wait = m.config.Max
+	}
+	return timerAt(now.Add(wait))
+}
+
+// fixedTiming always waits the same interval.
+type fixedTiming struct {
+	interval time.Duration
+}
+
+func (f fixedTiming) Timer(now time.Time) (*time.Timer, time.Time) {
+	return timerAt(now.Add(f.interval))
+}
+
+// cronTiming waits until the next time of a cron schedule, in UTC.
+type cronTiming struct {
+	schedule cron.Schedule
+}
+
+func (c cronTiming) Timer(now time.Time) (*time.Timer, time.Time) {
+	return timerAt(c.schedule.Next(now.UTC()))
+}
+
+// jitteredTiming waits like another Timing, and then up to jitter more.
+type jitteredTiming struct {
+	Timing
+	jitter time.Duration
+}
+
+func (j jitteredTiming) Timer(now time.Time) (*time.Timer, time.Time) {
+	t, next := j.Timing.Timer(now)
+	t.Stop()
+	return timerAt(next.Add(time.Duration(rand.Int63n(int64(j.jitter)))))
+}
+
+// The states of a Run.
+const (
+	Pending   = "pending" // Waiting for an earlier run of its job to finish.
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Canceled  = "canceled"
+)
+
+// keptRuns is how many finished runs are remembered, to be looked up.
+const keptRuns = 100
+
+// ErrUnknownJob is returned by Trigger for a job that was never added.
+var ErrUnknownJob = errors.New("unknown job")
+
+// ErrNotRunning is returned by Trigger when the Scheduler is not running.
+var ErrNotRunning = errors.New("scheduler is not running")
+
+// ErrUnknownRun is returned for a run ID that is unknown, or forgotten.
+var ErrUnknownRun = errors.New("unknown run")
+
+// ErrFinished is returned by Cancel for a run that has already finished.
+var ErrFinished = errors.New("run has already finished")
+
+// Run describes a single run of a job, whether scheduled or triggered.
+type Run struct {
+	ID     string    `json:"id"`
+	Job    string    `json:"job"`
+	Manual bool      `json:"manual"`
+	State  string    `json:"state"`
+	Error  string    `json:"error,omitempty"`
+	Queued time.Time `json:"queued"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// The last time the run reported progress with Heartbeat.
+	Progress time.Time `json:"progress"`
+}
+
+// Finished returns whether r is over, however it ended.
+func (r Run) Finished() bool {
+	return r.State == Succeeded || r.State == Failed || r.State == Canceled
+}
+
+// run is the Scheduler's own record of a Run.
+type run struct {
+	Run
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// job is a named function that is run on a Timing.
+type job struct {
+	name   string
+	timing Timing
+	run    func(ctx context.Context) error
+	// busy holds a token while the job runs, so that its runs never overlap.
+	busy chan struct{}
+	// When the job is next scheduled to run, once it has run.
+	next time.Time
+}
+
+// Scheduler runs every job it was given in its own goroutine, once right
+// away and then whenever its Timing says so. A job may also be run on
+// demand with Trigger. The runs of a job, scheduled or not, never overlap.
+type Scheduler struct {
+	// How long runs that are in flight when the Scheduler is stopped may
+	// go on, to finish their uploads, before their context is canceled.
+	Grace time.Duration
+
+	mu       sync.Mutex
+	jobs     []*job
+	ctx      context.Context // Set while the Scheduler is running.
+	runCtx   context.Context
+	runs     map[string]*run
+	finished []string // The IDs of finished runs, oldest first.
+	nextID   int
+	inFlight sync.WaitGroup
+}
+
+// Add adds a job named name, which calls run on timing. run should return
+// soon after its context is done.
+func (s *Scheduler) Add(name string, timing Timing, run func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job{name: name, timing: timing, run: run, busy: make(chan struct{}, 1)})
+}
+
+// Jobs returns the names of the jobs, in the order they were added.
+func (s *Scheduler) Jobs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, j := range s.jobs {
+		names = append(names, j.name)
+	}
+	return names
+}
+
+// NextRun returns when the job named name is next scheduled to run, or
+// the zero time if its scheduled run is in flight, or it has not run yet.
+func (s *Scheduler) NextRun(name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j.next
+		}
+	}
+	return time.Time{}
+}
+
+// Run runs the jobs until ctx is done. No run is started after that, and
+// the runs in flight have s.Grace to finish before their own context is
+// canceled. Run returns once they all have returned.
+func (s *Scheduler) Run(ctx context.Context) {
+	// Runs get a context that outlives ctx by the grace period.
+	runCtx, cancelRuns := context.WithCancel(context.Background())
+	defer cancelRuns()
+	go func() {
+		select {
+		case <-runCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		if Sleep(runCtx, s.Grace) == nil {
+			log.Println("Aborting the runs still in flight after", s.Grace)
+			cancelRuns()
+		}
+	}()
+
+	s.mu.Lock()
+	s.ctx, s.runCtx = ctx, runCtx
+	jobs := append([]*job(nil), s.jobs...)
+	s.mu.Unlock()
+	for _, j := range jobs {
+		s.inFlight.Add(1)
+		go func(j *job) {
+			defer s.inFlight.Done()
+			for ctx.Err() == nil {
+				if r := s.newRun(j, false); r != nil {
+					s.execute(j, r)
+				}
+				t, next := j.timing.Timer(time.Now())
+				s.mu.Lock()
+				j.next = next
+				s.mu.Unlock()
+				waitFor(ctx, t)
+				t.Stop()
+			}
+		}(j)
+	}
+	// Triggered runs are waited for too. None is started once ctx is done.
+	<-ctx.Done()
+	s.mu.Lock()
+	s.ctx, s.runCtx = nil, nil
+	s.mu.Unlock()
+	s.inFlight.Wait()
+}
+
+// Trigger starts a run of the job named name right away, or as soon as
+// the run of it in flight is over, and returns it. It doesn't wait for
+// the run to finish.
+func (s *Scheduler) Trigger(name string) (Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil || s.ctx.Err() != nil {
+		return Run{}, ErrNotRunning
+	}
+	for _, j := range s.jobs {
+		if j.name != name {
+			continue
+		}
+		r := s.newRunLocked(j, true)
+		s.inFlight.Add(1)
+		go func() {
+			defer s.inFlight.Done()
+			s.execute(j, r)
+		}()
+		return r.Run, nil
+	}
+	return Run{}, ErrUnknownJob
+}
+
+// newRun records a new pending run of j, or returns nil if the Scheduler
+// is stopping.
+func (s *Scheduler) newRun(j *job, manual bool) *run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil || s.ctx.Err() != nil {
+		return nil
+	}
+	return s.newRunLocked(j, manual)
+}
+
+// newRunLocked is newRun for callers that hold s.mu, and have checked
+// that the Scheduler is running.
+func (s *Scheduler) newRunLocked(j *job, manual bool) *run {
+	s.nextID++
+	if !manual {
+		j.next = time.Time{}
+	}
+	ctx, cancel := context.WithCancel(s.runCtx)
+	r := &run{
+		Run: Run{
+			ID:     strconv.Itoa(s.nextID),
+			Job:    j.name,
+			Manual: manual,
+			State:  Pending,
+			Queued: time.Now().UTC(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	r.ctx = context.WithValue(ctx, heartbeatKey{}, heartbeat{s, r})
+	if s.runs == nil {
+		s.runs = map[string]*run{}
+	}
+	s.runs[r.ID] = r
+	return r
+}
+
+// execute waits for j to be free and then runs r, unless r is canceled
+// first.
+func (s *Scheduler) execute(j *job, r *run) {
+	defer s.finish(r)
+	select {
+	case j.busy <- struct{}{}:
+		defer func() { <-j.busy }()
+	case <-r.ctx.Done():
+		return
+	}
+	s.mu.Lock()
+	r.State, r.Start = Running, time.Now().UTC()
+	s.mu.Unlock()
+	err := j.run(r.ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		r.State, r.Error = Failed, err.Error()
+	} else {
+		r.State = Succeeded
+	}
+}
+
+// finish marks r as over, forgetting the oldest finished runs.
+func (s *Scheduler) finish(r *run) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.ctx.Err() != nil && r.State != Succeeded {
+		r.State = Canceled
+		if r.Error == "" {
+			r.Error = r.ctx.Err().Error()
+		}
+	}
+	r.End = time.Now().UTC()
+	r.cancel()
+	close(r.done)
+	s.finished = append(s.finished, r.ID)
+	for len(s.finished) > keptRuns {
+		delete(s.runs, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+// Runs returns the runs in flight and the most recent finished ones, in
+// the order they were queued.
+func (s *Scheduler) Runs() []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := make([]Run, 0, len(s.runs))
+	for _, r := range s.runs {
+		runs = append(runs, r.Run)
+	}
+	sort.Slice(runs, func(i, k int) bool {
+		a, _ := strconv.Atoi(runs[i].ID)
+		b, _ := strconv.Atoi(runs[k].ID)
+		return a < b
+	})
+	return runs
+}
+
+// Lookup returns the run with the given ID.
+func (s *Scheduler) Lookup(id string) (Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.runs[id]
+	if !ok {
+		return Run{}, ErrUnknownRun
+	}
+	return r.Run, nil
+}
+
+// Wait waits for the run with the given ID to finish, and returns it. If
+// ctx is done first, the run is returned as it is, with ctx.Err().
+func (s *Scheduler) Wait(ctx context.Context, id string) (Run, error) {
+	s.mu.Lock()
+	r, ok := s.runs[id]
+	s.mu.Unlock()
+	if !ok {
+		return Run{}, ErrUnknownRun
+	}
+	var err error
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return r.Run, err
+}
+
+// Cancel cancels the run with the given ID, whether it is pending or in
+// flight, and returns it. A run in flight may take a moment to stop.
+func (s *Scheduler) Cancel(id string) (Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.runs[id]
+	if !ok {
+		return Run{}, ErrUnknownRun
+	}
+	if r.Finished() {
+		return r.Run, ErrFinished
+	}
+	r.cancel()
+	return r.Run, nil
+}
+
+// heartbeatKey is the context key of the heartbeat of a run.
+type heartbeatKey struct{}
+
+// heartbeat is what Heartbeat needs to record the progress of a run.
+type heartbeat struct {
+	s *Scheduler
+	r *run
+}
+
+// Heartbeat records that the run whose context is ctx, or a context
+// derived from it, is making progress. It does nothing for other contexts.
+func Heartbeat(ctx context.Context) {
+	h, ok := ctx.Value(heartbeatKey{}).(heartbeat)
+	if !ok {
+		return
+	}
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	h.r.Progress = time.Now().UTC()
+}
+
+// Stalled returns the runs in flight that have neither started nor made
+// progress within bound, such as a run stuck on a download that hangs.
+func (s *Scheduler) Stalled(bound time.Duration) []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stalled []Run
+	for _, r := range s.runs {
+		if r.State != Running {
+			continue
+		}
+		last := r.Start
+		if r.Progress.After(last) {
+			last = r.Progress
+		}
+		if time.Since(last) > bound {
+			stalled = append(stalled, r.Run)
+		}
+	}
+	return stalled
+}
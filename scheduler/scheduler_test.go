@@ -0,0 +1,297 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	conf "github.com/m-lab/downloader/config"
+)
+
+func TestSleep(t *testing.T) {
+	if err := Sleep(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("Sleep() returned %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := Sleep(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("Sleep() returned %v, expected %v", err, context.Canceled)
+	}
+	if time.Since(start) > time.Minute {
+		t.Error("Sleep() did not return when its context was canceled")
+	}
+}
+
+func TestNewTiming(t *testing.T) {
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		schedule conf.Schedule
+		errText  string
+		min, max time.Duration // The bounds of the next run, after now.
+	}{
+		{name: "memoryless", schedule: conf.Schedule{Kind: conf.ScheduleMemoryless, Interval: time.Hour, Min: time.Minute, Max: 2 * time.Hour}, min: time.Minute, max: 2 * time.Hour},
+		{name: "memoryless by default", schedule: conf.Schedule{Interval: time.Hour, Max: 2 * time.Hour}, max: 2 * time.Hour},
+		{name: "memoryless bad", schedule: conf.Schedule{Interval: time.Hour, Min: 2 * time.Hour}, errText: "make no sense"},
+		{name: "memoryless jitter", schedule: conf.Schedule{Interval: time.Hour, Max: 2 * time.Hour, Jitter: time.Minute}, max: 2*time.Hour + time.Minute},
+		{name: "fixed", schedule: conf.Schedule{Kind: conf.ScheduleFixed, Interval: time.Hour}, min: time.Hour, max: time.Hour},
+		{name: "fixed without interval", schedule: conf.Schedule{Kind: conf.ScheduleFixed}, errText: "invalid interval"},
+		{name: "jitter", schedule: conf.Schedule{Kind: conf.ScheduleFixed, Interval: time.Hour, Jitter: time.Minute}, min: time.Hour, max: time.Hour + time.Minute},
+		// now is a Monday.
+		{name: "cron", schedule: conf.Schedule{Kind: conf.ScheduleCron, Cron: "0 6 * * 2,5"}, min: 18 * time.Hour, max: 18 * time.Hour},
+		{name: "cron bad", schedule: conf.Schedule{Kind: conf.ScheduleCron, Cron: "0 6 * *"}, errText: "exactly 5 fields"},
+		{name: "unknown", schedule: conf.Schedule{Kind: "hourly"}, errText: "unknown schedule kind"},
+	}
+	for _, test := range tests {
+		timing, err := NewTiming(test.schedule)
+		if test.errText != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errText) {
+				t.Errorf("%s: NewTiming() returned %v, expected an error containing %q", test.name, err, test.errText)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: NewTiming() returned %v", test.name, err)
+			continue
+		}
+		for i := 0; i < 100; i++ {
+			timer, next := timing.Timer(now)
+			timer.Stop()
+			if wait := next.Sub(now); wait < test.min || wait > test.max {
+				t.Errorf("%s: Timer() is %v after now, expected between %v and %v", test.name, wait, test.min, test.max)
+				break
+			}
+		}
+	}
+}
+
+// everyMillisecond is a Timing for tests.
+type everyMillisecond struct{}
+
+func (everyMillisecond) Timer(now time.Time) (*time.Timer, time.Time) {
+	return timerAt(now.Add(time.Millisecond))
+}
+
+func TestScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scheduler{Grace: time.Minute}
+	var runs, finished int32
+	s.Add("count", everyMillisecond{}, func(ctx context.Context) error {
+		if atomic.AddInt32(&runs, 1) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	s.Add("upload", everyMillisecond{}, func(ctx context.Context) error {
+		// A run in flight at shutdown is allowed to finish.
+		<-time.After(10 * time.Millisecond)
+		if ctx.Err() == nil {
+			atomic.AddInt32(&finished, 1)
+		}
+		return nil
+	})
+	s.Run(ctx)
+	if runs != 3 {
+		t.Errorf("Run() ran the job %d times after it was stopped, expected 3", runs)
+	}
+	if finished == 0 {
+		t.Error("Run() canceled a run before the grace period was over")
+	}
+}
+
+func TestSchedulerGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scheduler{Grace: time.Millisecond}
+	aborted := false
+	s.Add("stuck", everyMillisecond{}, func(runCtx context.Context) error {
+		cancel()
+		// A run that doesn't finish in time is canceled.
+		select {
+		case <-runCtx.Done():
+			aborted = true
+		case <-time.After(time.Minute):
+		}
+		return runCtx.Err()
+	})
+	s.Run(ctx)
+	if !aborted {
+		t.Error("Run() did not cancel a run after the grace period")
+	}
+}
+
+// never is a Timing for tests, which only runs a job again when it is
+// triggered.
+type never struct{}
+
+func (never) Timer(now time.Time) (*time.Timer, time.Time) {
+	return timerAt(now.Add(24 * time.Hour))
+}
+
+// startScheduler runs s until the returned function is called, which
+// waits for Run to return.
+func startScheduler(t *testing.T, s *Scheduler) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(stopped)
+	}()
+	// Wait for the scheduled runs to start.
+	for len(s.Runs()) < len(s.Jobs()) {
+		time.Sleep(time.Millisecond)
+	}
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+func TestSchedulerTrigger(t *testing.T) {
+	s := &Scheduler{Grace: time.Minute}
+	if _, err := s.Trigger("fetch"); err != ErrNotRunning {
+		t.Errorf("Trigger() returned %v before Run, expected %v", err, ErrNotRunning)
+	}
+	var running, overlaps int32
+	release := make(chan struct{})
+	s.Add("fetch", never{}, func(ctx context.Context) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		<-release
+		return errors.New("no luck")
+	})
+	stop := startScheduler(t, s)
+	defer stop()
+
+	if _, err := s.Trigger("other"); err != ErrUnknownJob {
+		t.Errorf("Trigger() returned %v for an unknown job, expected %v", err, ErrUnknownJob)
+	}
+	// The scheduled run is in flight, so the triggered one has to wait.
+	r, err := s.Trigger("fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != Pending || !r.Manual {
+		t.Errorf("Trigger() returned %+v, expected a pending manual run", r)
+	}
+	close(release)
+	r, err = s.Wait(context.Background(), r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.State != Failed || r.Error != "no luck" || r.Start.IsZero() {
+		t.Errorf("Wait() returned %+v, expected a failed run", r)
+	}
+	if overlaps != 0 {
+		t.Errorf("Runs of the same job overlapped %d times", overlaps)
+	}
+	// The scheduled run is over too, so the next one is known.
+	next := s.NextRun("fetch")
+	for start := time.Now(); next.IsZero() && time.Since(start) < time.Minute; next = s.NextRun("fetch") {
+		time.Sleep(time.Millisecond)
+	}
+	if until := time.Until(next); until <= 23*time.Hour || until > 24*time.Hour {
+		t.Errorf("NextRun() is %v away, expected a day", until)
+	}
+	if runs := s.Runs(); len(runs) != 2 || runs[0].Manual || runs[1].ID != r.ID {
+		t.Errorf("Runs() returned %+v, expected the scheduled run and then the manual one", runs)
+	}
+	if _, err := s.Lookup("nope"); err != ErrUnknownRun {
+		t.Errorf("Lookup() returned %v, expected %v", err, ErrUnknownRun)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	// The last run is left to be aborted at shutdown.
+	s := &Scheduler{Grace: time.Millisecond}
+	started := make(chan struct{}, 10)
+	s.Add("fetch", never{}, func(ctx context.Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	stop := startScheduler(t, s)
+	defer stop()
+	<-started
+
+	scheduled := s.Runs()[0]
+	pending, err := s.Trigger("fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A pending run is canceled without ever running.
+	if _, err := s.Cancel(pending.ID); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.Wait(context.Background(), pending.ID); r.State != Canceled || !r.Start.IsZero() {
+		t.Errorf("Wait() returned %+v, expected a run canceled before it started", r)
+	}
+	// So is a run in flight.
+	if _, err := s.Cancel(scheduled.ID); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := s.Wait(context.Background(), scheduled.ID); r.State != Canceled {
+		t.Errorf("Wait() returned %+v, expected a canceled run", r)
+	}
+	if _, err := s.Cancel(scheduled.ID); err != ErrFinished {
+		t.Errorf("Cancel() returned %v for a finished run, expected %v", err, ErrFinished)
+	}
+	// The job is free again.
+	if _, err := s.Trigger("fetch"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Minute):
+		t.Error("The job did not run after its runs were canceled")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := s.Wait(ctx, s.Runs()[2].ID); err != context.DeadlineExceeded {
+		t.Errorf("Wait() returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestStalled(t *testing.T) {
+	s := &Scheduler{Grace: time.Millisecond}
+	beat := make(chan struct{})
+	s.Add("stuck", never{}, func(ctx context.Context) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-beat:
+				Heartbeat(ctx)
+				beat <- struct{}{}
+			}
+		}
+	})
+	stop := startScheduler(t, s)
+	defer stop()
+	for s.Runs()[0].State != Running {
+		time.Sleep(time.Millisecond)
+	}
+
+	if stalled := s.Stalled(time.Hour); len(stalled) != 0 {
+		t.Errorf("Stalled() returned %+v for a run that just started", stalled)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if stalled := s.Stalled(5 * time.Millisecond); len(stalled) != 1 {
+		t.Errorf("Stalled() returned %+v, expected the run", stalled)
+	}
+	beat <- struct{}{}
+	<-beat
+	if stalled := s.Stalled(5 * time.Millisecond); len(stalled) != 0 {
+		t.Errorf("Stalled() returned %+v for a run that made progress", stalled)
+	}
+	if s.Runs()[0].Progress.IsZero() {
+		t.Error("Heartbeat() did not record the progress of the run")
+	}
+	// Contexts that are not of a run are ignored.
+	Heartbeat(context.Background())
+}